@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Permissions of the files and directories of the store. A shared store
+// is accessible by the group of the store directory, a private one only
+// by the owner. They are set by getIndex.
+// Blobs are read only, so that history is not altered by accident.
+var (
+	dirMode  os.FileMode = 0700
+	fileMode os.FileMode = 0600
+	blobMode os.FileMode = 0400
+)
+
+// mkdir creates the directory with dirMode. The mode of a new directory
+// lacks the setgid bit of shared stores, it is set explicitly so that the
+// files of the directory belong to the group of the store.
+func mkdir(dir string) error {
+	if err := os.Mkdir(dir, dirMode); err != nil {
+		return err
+	}
+	if dirMode&os.ModeSetgid != 0 {
+		return os.Chmod(dir, dirMode)
+	}
+	return nil
+}
+
+// mkdirAll creates the directory and its missing parents like mkdir
+func mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	if dirMode&os.ModeSetgid != 0 {
+		for _, d := range missing {
+			if err := os.Chmod(d, dirMode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// currentUser returns the name of the user running sgvc
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid%d", os.Getuid())
+}
+
+// checkAccess checks that the user is allowed the access, "r" or "w",
+// by the policy file of the store. The policy file has lines of user
+// names, or * for all users, followed by the allowed access, for example
+//
+//	alice rw
+//	* r
+//
+// If there is no policy file, everything is allowed. The policy protects
+// against mistakes, the permissions of the files protect against users.
+func checkAccess(workDir, access string) error {
+	fin, err := os.Open(filepath.Join(workDir, "policy"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	name := currentUser()
+	allowed, found := "", false
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// an entry for the user overrides the entry for all users
+		if fields[0] == name || fields[0] == "*" && !found {
+			allowed = fields[1]
+			found = fields[0] == name
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !strings.Contains(allowed, access) {
+		return fmt.Errorf("user %s is not allowed %q access to the store by its policy", name, access)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Backups are tar archives of the store. A full backup has the blobs of
+// all the versions and the index, manifest, labels and refs files and is itself
+// a store when extracted. An incremental backup, since a checkpoint, has
+// the blobs and the index lines added since, in index.added, which are
+// appended to the index of the extracted store. Every backup records a
+// checkpoint, the lines of the index it saved, in the backups directory
+// of the store.
+
+// backupsDir returns the directory of the checkpoints of the backups
+func (idx *index) backupsDir() string {
+	return filepath.Join(idx.workDir, "backups")
+}
+
+// checkpoints returns the ids of the checkpoints, oldest first
+func (idx *index) checkpoints() ([]string, error) {
+	entries, err := os.ReadDir(idx.backupsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasSuffix(e.Name(), ".tmp") {
+			ids = append(ids, e.Name())
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// loadCheckpoint returns the index lines saved by the backup of the
+// checkpoint. last is the latest checkpoint.
+func (idx *index) loadCheckpoint(id string) (string, map[string]bool, error) {
+	if id == "last" {
+		ids, err := idx.checkpoints()
+		if err != nil {
+			return "", nil, err
+		}
+		if len(ids) == 0 {
+			return "", nil, errors.New("no backups yet, make a full backup first")
+		}
+		id = ids[len(ids)-1]
+	}
+	fin, err := os.Open(filepath.Join(idx.backupsDir(), filepath.Base(id)))
+	if err != nil {
+		return "", nil, fmt.Errorf("no checkpoint %s: %w", id, err)
+	}
+	defer fin.Close()
+	lines := make(map[string]bool)
+	scanner := bufio.NewScanner(fin)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines[scanner.Text()] = true
+	}
+	return id, lines, scanner.Err()
+}
+
+// backup writes a tar archive of the store to the file, - for the
+// standard output, with the versions added since the checkpoint or all
+// of them if since is empty, and records a new checkpoint whose id it
+// returns.
+func (idx *index) backup(fname, since string) (string, error) {
+	if err := idx.lock(); err != nil {
+		return "", err
+	}
+	defer idx.unlock()
+	// reload, the index may have changed before locking
+	if err := idx.loadCommits(); err != nil {
+		return "", err
+	}
+
+	var saved map[string]bool
+	if since != "" {
+		var err error
+		if since, saved, err = idx.loadCheckpoint(since); err != nil {
+			return "", err
+		}
+	}
+	current := make(map[string]bool)
+	var lines []string
+	for _, cmt := range idx.commits {
+		line := cmt.serialize()
+		current[line] = true
+		if !saved[line] {
+			lines = append(lines, line)
+		}
+	}
+	savedBlobs := make(map[string]bool)
+	rewritten := false
+	for line := range saved {
+		rewritten = rewritten || !current[line]
+		if cmt, err := deserializeCommit(line); err == nil {
+			savedBlobs[blobName(cmt, idx.manifest.format, idx.manifest.layout)] = true
+		}
+	}
+	if rewritten {
+		log.Printf("WARNING: the index was rewritten since the checkpoint %s, the incremental backup does not remove versions, make a full backup", since)
+	}
+
+	out := os.Stdout
+	if fname != "-" {
+		var err error
+		if out, err = os.Create(fname + ".tmp"); err != nil {
+			return "", err
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+	}
+
+	tw := tar.NewWriter(out)
+	addFile := func(name, src string) error {
+		fin, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer fin.Close()
+		fi, err := fin.Stat()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, fin)
+		return err
+	}
+	added := make(map[string]bool)
+	for _, cmt := range idx.commits {
+		name := blobName(cmt, idx.manifest.format, idx.manifest.layout)
+		if savedBlobs[name] || added[name] {
+			continue
+		}
+		added[name] = true
+		if err := addFile(name, idx.filePath(cmt)); err != nil {
+			return "", fmt.Errorf("version %d of %s: %w", cmt.version, cmt.path, err)
+		}
+	}
+	for _, name := range []string{"manifest", "labels", "refs"} {
+		err := addFile(name, filepath.Join(idx.workDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	name := "index"
+	if since != "" {
+		name = "index.added"
+	}
+	data := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		data += "\n"
+	}
+	hdr := &tar.Header{Name: name, Mode: int64(fileMode), Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(tw, data); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if fname != "-" {
+		if err := out.Sync(); err != nil {
+			return "", err
+		}
+		if err := out.Close(); err != nil {
+			return "", err
+		}
+		if err := os.Rename(out.Name(), fname); err != nil {
+			return "", err
+		}
+	}
+
+	// the checkpoint is recorded only after the archive is written
+	return idx.saveCheckpoint(current)
+}
+
+// saveCheckpoint records the index lines of a backup and returns the id
+// of the checkpoint
+func (idx *index) saveCheckpoint(lines map[string]bool) (string, error) {
+	if err := mkdirAll(idx.backupsDir()); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	id := now.Format("20060102T150405")
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(idx.backupsDir(), id)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%s.%d", now.Format("20060102T150405"), n)
+	}
+	sorted := make([]string, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	slices.Sort(sorted)
+	fname := filepath.Join(idx.backupsDir(), id)
+	if err := appendLines(fname+".tmp", sorted); err != nil {
+		os.Remove(fname + ".tmp")
+		return "", err
+	}
+	return id, os.Rename(fname+".tmp", fname)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// branch is a lineage of versions of a file, from a root to a version
+// that no other version is based on
+type branch struct {
+	tip    *commit
+	length int       // versions from the root to the tip
+	last   time.Time // of the most recent version of the lineage
+}
+
+// branches returns the lineages of the versions of the file in the
+// order of their tips
+func (idx *index) branches(path string) []branch {
+	var found []branch
+	var walk func(cmt *commit, length int, last time.Time)
+	walk = func(cmt *commit, length int, last time.Time) {
+		if cmt.when.After(last) {
+			last = cmt.when
+		}
+		if len(cmt.descs) == 0 {
+			found = append(found, branch{cmt, length, last})
+		}
+		for _, c := range cmt.descs {
+			walk(c, length+1, last)
+		}
+	}
+	for _, root := range idx.treeOfCommits(path).descs {
+		walk(root, 1, time.Time{})
+	}
+	slices.SortFunc(found, func(a, b branch) int { return cmp.Compare(a.tip.version, b.tip.version) })
+	return found
+}
+
+// printBranches prints the lineages of the file, one per line, with the
+// tip version, the length and the time of the last activity. The lineage
+// of the latest version is marked with a *.
+func (idx *index) printBranches(w io.Writer, path string) {
+	latest := idx.currVersion(path)
+	for _, b := range idx.branches(path) {
+		mark := " "
+		if b.tip.version == latest {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s %0*d\t%d\t%s\t%s\n", mark, versionWidth, b.tip.version, b.length,
+			b.last.Format(time.RFC3339), b.tip.changes)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/gob"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFormat must change whenever the cached commit fields change
+const cacheFormat = 12
+
+// indexCache is the parsed index stored in a sidecar file. It is valid
+// as long as the size and the modification time of the index are unchanged.
+type indexCache struct {
+	Format  int
+	Size    int64
+	ModTime int64
+	Commits []cachedCommit
+
+	Quarantined []string
+}
+
+type cachedCommit struct {
+	Path     string
+	When     time.Time
+	Version  int
+	BasedOn  int
+	PathSig  string
+	DataCrc  uint32
+	Changes  string
+	Size     int64
+	ModTime  time.Time
+	Mode     os.FileMode
+	Meta     map[string]string
+	Dev      uint64
+	Ino      uint64
+	Author   string
+	Xattrs   map[string]string
+	Encoding string
+	Delta    int
+	Sum      string
+	Hash     string
+}
+
+// cacheFile returns the path of the index cache
+func (idx *index) cacheFile() string {
+	return filepath.Join(idx.workDir, "index.cache")
+}
+
+// loadCache returns the cached commits and quarantined lines if the cache matches the index
+func (idx *index) loadCache(fi os.FileInfo) ([]*commit, []string, bool) {
+	fin, err := os.Open(idx.cacheFile())
+	if err != nil {
+		return nil, nil, false
+	}
+	defer fin.Close()
+
+	var ic indexCache
+	if err := gob.NewDecoder(fin).Decode(&ic); err != nil {
+		return nil, nil, false
+	}
+	if ic.Format != cacheFormat || ic.Size != fi.Size() || ic.ModTime != fi.ModTime().UnixNano() {
+		return nil, nil, false
+	}
+	commits := make([]*commit, len(ic.Commits))
+	for i, c := range ic.Commits {
+		commits[i] = &commit{
+			path:     c.Path,
+			when:     c.When,
+			version:  c.Version,
+			basedOn:  c.BasedOn,
+			pathSig:  c.PathSig,
+			dataCrc:  c.DataCrc,
+			changes:  c.Changes,
+			size:     c.Size,
+			mtime:    c.ModTime,
+			mode:     c.Mode,
+			meta:     c.Meta,
+			dev:      c.Dev,
+			ino:      c.Ino,
+			author:   c.Author,
+			xattrs:   c.Xattrs,
+			encoding: c.Encoding,
+			delta:    c.Delta,
+			sum:      c.Sum,
+			hash:     c.Hash,
+		}
+	}
+	for _, line := range ic.Quarantined {
+		log.Printf("WARNING: ignoring damaged index line %q. Run sgvc -compact to quarantine it", line)
+	}
+	return commits, ic.Quarantined, true
+}
+
+// saveCache writes the commits and the quarantined lines to the cache.
+// Failures are ignored since the cache can always be recreated from the index.
+func (idx *index) saveCache(fi os.FileInfo, commits []*commit, quarantined []string) {
+	ic := indexCache{
+		Format:      cacheFormat,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime().UnixNano(),
+		Commits:     make([]cachedCommit, len(commits)),
+		Quarantined: quarantined,
+	}
+	for i, c := range commits {
+		ic.Commits[i] = cachedCommit{
+			Path:     c.path,
+			When:     c.when,
+			Version:  c.version,
+			BasedOn:  c.basedOn,
+			PathSig:  c.pathSig,
+			DataCrc:  c.dataCrc,
+			Changes:  c.changes,
+			Size:     c.size,
+			ModTime:  c.mtime,
+			Mode:     c.mode,
+			Meta:     c.meta,
+			Dev:      c.dev,
+			Ino:      c.ino,
+			Author:   c.author,
+			Xattrs:   c.xattrs,
+			Encoding: c.encoding,
+			Delta:    c.delta,
+			Sum:      c.sum,
+			Hash:     c.hash,
+		}
+	}
+
+	// write to a temp file and rename, so concurrent readers never see a partial cache
+	tmp, err := createTemp()
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(&ic); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), idx.cacheFile())
+}
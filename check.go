@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxCheckOutput is the length of the output of a check kept in the commit
+const maxCheckOutput = 200
+
+// runChecks runs the check commands of the configuration that apply to the
+// file and returns their results as commit metadata, check.<command>
+// with ok or failed followed by the output. A check is a sh(1) command
+// line with the file as $1, for example
+//
+//	check /etc/nginx/*.conf = nginx -t -c "$1"
+func runChecks(path string) map[string]string {
+	results := make(map[string]string)
+	for _, command := range conf.allForPath("check", path) {
+		out, err := exec.Command("sh", "-c", command, "sh", path).CombinedOutput()
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		if s := strings.Join(strings.Fields(string(out)), " "); s != "" {
+			if len(s) > maxCheckOutput {
+				// do not cut a character
+				n := maxCheckOutput
+				for n > 0 && !utf8.RuneStart(s[n]) {
+					n--
+				}
+				s = s[:n] + "..."
+			}
+			result += ": " + s
+		}
+		name := command
+		if fields := strings.Fields(command); len(fields) > 0 {
+			name = fields[0]
+		}
+		results["check."+name] = result
+	}
+	return results
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"slices"
+	"time"
+)
+
+// clockSkew is the default clock-skew of the configuration
+const clockSkew = 5 * time.Minute
+
+// maxClockSkew returns how far the clock may be behind the latest version
+// of a file for new versions to get the time of the latest version
+func maxClockSkew() time.Duration {
+	v := conf.get("clock-skew")
+	if v == "" {
+		return clockSkew
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("WARNING: invalid clock-skew %q, using %v", v, clockSkew)
+		return clockSkew
+	}
+	return d
+}
+
+// orderedTimes returns the times that order the commits. The versions of
+// a file are a monotonic sequence, so a version is never before the
+// versions it follows, even if the clock of the machine that committed
+// it was behind. Its time is the latest time of it and its predecessors.
+func orderedTimes(commits []*commit) map[*commit]time.Time {
+	sorted := slices.Clone(commits)
+	slices.SortFunc(sorted, func(a, b *commit) int {
+		if c := cmp.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.version, b.version)
+	})
+	times := make(map[*commit]time.Time, len(sorted))
+	var last time.Time
+	for i, cmt := range sorted {
+		if i == 0 || sorted[i-1].path != cmt.path || cmt.when.After(last) {
+			last = cmt.when
+		}
+		times[cmt] = last
+	}
+	return times
+}
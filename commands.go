@@ -0,0 +1,1662 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command is a subcommand, sgvc <name> [flags] [args]. A command accepts
+// only the flags that apply to it and runs with its flag set and the
+// arguments left after its flags.
+type command struct {
+	name  string
+	args  string   // synopsis of the arguments
+	help  string   // one line description
+	flags []string // names of the flags of main accepted by the command
+	run   func(idx *index, fs *flag.FlagSet, args []string) error
+}
+
+// usageError is the error of a command line that does not match the
+// synopsis of the command, with a message or not
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+var errUsage = usageError("")
+
+// exitCode is the error of a command that reported its failure already
+// and exits with the code
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+var commands = []*command{
+	{"add", "[-m <message>] <file>...", "commit the files, with the message composed in $EDITOR without -m", []string{"add-file", "base", "meta", "force", "stdin", "files", "when"}, cmdAdd},
+	{"log", "[<file>]", "print the commits of the file or all files", []string{"meta"}, cmdLog},
+	{"search", "-message <text> [<file>]", "print the commits with messages containing the text", []string{"message", "meta"}, cmdSearch},
+	{"query", "<expression> [<file>]", "print the commits that match the filter expression", nil, cmdQuery},
+	{"tree", "[<file>]", "print the tree of versions", []string{"full"}, cmdTree},
+	{"branches", "<file>", "list the lineages of versions of the file", nil, cmdBranches},
+	{"list", "", "print the tracked files", nil, cmdList},
+	{"timeline", "", "print the commits of all files in chronological order", []string{"since", "until", "meta"}, cmdTimeline},
+	{"status", "<file>", "print whether the file is clean, modified or untracked", nil, cmdStatus},
+	{"cat", "<file>", "print a version of the file", []string{"version", "lines"}, cmdCat},
+	{"grep", "<regexp> <file>", "print the lines of a version that match the regular expression", []string{"version"}, cmdGrep},
+	{"diff", "[<file>]", "diff versions of the file, or the working copy", []string{"from", "to", "all", "raw", "key", "imgdiff"}, cmdDiff},
+	{"history-diff", "<file>", "diff every version of the file with its parent", []string{"o", "raw", "key", "imgdiff"}, cmdHistoryDiff},
+	{"restore", "<file>", "overwrite the file with a version", []string{"version", "save-current", "link", "meta"}, cmdRestore},
+	{"export", "<file>", "write a version, or a -range of versions, to the output directory", []string{"version", "range", "o"}, cmdExport},
+	{"export-git", "<dir>", "print a git fast-import stream with the histories of the files under the directory", nil, cmdExportGit},
+	{"import-git", "<dir> <file>...", "commit the git histories of untracked files, like of etckeeper, as their versions", []string{"meta"}, cmdImportGit},
+	{"export-script", "<file>", "print a shell script that recreates the history of the file", nil, cmdExportScript},
+	{"edit", "<file>", "commit the file, open it in $EDITOR and commit the changes", []string{"meta"}, cmdEdit},
+	{"run", "-m <message> <file> -- <command>...", "run the command and commit the file if it changes", []string{"meta"}, cmdRun},
+	{"amend", "-m <message> <file>", "replace the message of a version", []string{"version"}, cmdAmend},
+	{"undo", "<file>", "move the latest version of the file to the trash", nil, cmdUndo},
+	{"mv", "<file> <new file>", "move the file and its history, labels and refs", nil, cmdMove},
+	{"forget", "<file>", "stop tracking the file and move its versions to the trash", []string{"keep-blobs"}, cmdForget},
+	{"track", "-m <message> <file|dir|glob>...", "commit the first version of untracked files", []string{"meta"}, cmdTrack},
+	{"snapshot", "-m <message>", "commit the modified tracked files and the new files to track", []string{"meta"}, cmdSnapshot},
+	{"prepare", "-m <message> <file>...", "stage versions of the files and print the id to finalize or abort them", []string{"meta"}, cmdPrepare},
+	{"finalize", "<id>", "commit the staged versions together", nil, cmdFinalize},
+	{"abort", "<id>", "remove the staged versions", nil, cmdAbort},
+	{"label", "<name> [<file>...]", "label the latest versions of the files, or all tracked files", nil, cmdLabel},
+	{"labels", "", "print the labels", nil, cmdLabels},
+	{"restore-label", "<name>", "restore the files to their labelled versions", []string{"link"}, cmdRestoreLabel},
+	{"checkout-all", "-o <dir>", "write a version of every tracked file under the directory", []string{"o", "at", "label"}, cmdCheckoutAll},
+	{"env", "[<file|dir>...] -- <command>...", "run the command with SGVC_ROOT set to a temp directory with versions of the files", []string{"at", "label"}, cmdEnv},
+	{"identify", "<file>", "print the versions equal to the file", nil, cmdIdentify},
+	{"assert", "<file>", "exit with 0 only if the file equals a version", []string{"version"}, cmdAssert},
+	{"which", "<file>", "print the path of the stored contents of a version", []string{"version"}, cmdWhich},
+	{"find-hash", "<sha256>", "print the versions whose contents have the sha256", nil, cmdFindHash},
+	{"pin-ref", "<file> <ref>", "pin an external id, like a ticket, to -version of the file", []string{"version"}, cmdPinRef},
+	{"find-ref", "<ref>", "print the versions pinned to the external id", nil, cmdFindRef},
+	{"refs", "[<file>]", "print the external ids pinned to versions", nil, cmdRefs},
+	{"stats", "[<file>]", "print word, line and byte counts of versions", []string{"growth"}, cmdStats},
+	{"report", "<file>", "write an html report of the history", []string{"o"}, cmdReport},
+	{"verify", "<file>", "verify the stored versions of the file", nil, cmdVerify},
+	{"heal", "[<file>]", "restore corrupted versions from identical copies", nil, cmdHeal},
+	{"manifest", "[<file>] | -verify <manifest>", "print or verify the sha256 of every stored version", []string{"verify"}, cmdManifest},
+	{"dedupe", "[<file>]", "report identical contents stored more than once", nil, cmdDedupe},
+	{"compact", "", "rewrite the index sorted and normalized", nil, cmdCompact},
+	{"renames", "", "find tracked files that were renamed outside sgvc", []string{"auto-follow"}, cmdRenames},
+	{"diff-store", "<dir> [<file>]", "compare the versions with another store", nil, cmdDiffStore},
+	{"mirror", "", "copy the store to the mirror directory of the configuration", nil, cmdMirror},
+	{"backup", "<archive|->", "write a tar archive of the store or, with -since, of the versions added since a backup", []string{"since"}, cmdBackup},
+	{"link-latest", "", "maintain links to the latest versions in the store", nil, cmdLinkLatest},
+	{"trash", "list|empty|restore <id>", "manage the commits removed by destructive operations", nil, cmdTrash},
+	{"events", "", "print the operation log of the store", []string{"follow"}, cmdEvents},
+	{"info", "", "print health indicators of the store", []string{"check"}, cmdInfo},
+	{"doctor", "", "check the store and the environment for common problems", nil, cmdDoctor},
+	{"lock-status", "", "print the process holding the store lock", nil, cmdLockStatus},
+	{"break-lock", "", "remove the store lock of a crashed sgvc", nil, cmdBreakLock},
+	{"prompt", "", "print a short status of the current directory for shell prompts", nil, cmdPrompt},
+}
+
+// mainFlag is a flag of a command that sets the flag of main with the
+// same name, for flags that are not copied like repeated ones
+type mainFlag struct {
+	*flag.Flag
+}
+
+func (f mainFlag) String() string {
+	return ""
+}
+
+func (f mainFlag) Set(s string) error {
+	return flag.Set(f.Name, s)
+}
+
+func (f mainFlag) IsBoolFlag() bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagSet returns the flags of the command, copies of the flags of main
+// with the same defaults
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("sgvc "+c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: sgvc %s [flags] %s\n\n%s\n\nFlags:\n", c.name, c.args, c.help)
+		fs.PrintDefaults()
+	}
+	if strings.Contains(c.args, "-m <message>") {
+		fs.String("m", "", "commit message")
+	}
+	for _, name := range append(c.flags, "progress-fd") {
+		f := flag.Lookup(name)
+		var value any
+		if g, ok := f.Value.(flag.Getter); ok {
+			value = g.Get()
+		}
+		switch value.(type) {
+		case bool:
+			def, _ := strconv.ParseBool(f.DefValue)
+			fs.Bool(name, def, f.Usage)
+		case int:
+			def, _ := strconv.Atoi(f.DefValue)
+			fs.Int(name, def, f.Usage)
+		case string:
+			fs.String(name, f.DefValue, f.Usage)
+		default:
+			fs.Var(mainFlag{f}, name, f.Usage)
+		}
+	}
+	return fs
+}
+
+func boolFlag(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+func intFlag(fs *flag.FlagSet, name string) int {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+func stringFlag(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(string)
+}
+
+// isSet reports whether the flag was given in the command line
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// message returns the -m message of the commands that commit
+func message(fs *flag.FlagSet) (string, error) {
+	m := stringFlag(fs, "m")
+	if m == "" {
+		return "", usageError("missing -m message")
+	}
+	return m, nil
+}
+
+// firstArg splits the first argument of the commands that need one
+func firstArg(args []string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, usageError("missing argument")
+	}
+	return args[0], args[1:], nil
+}
+
+// fileArg returns the absolute path of the only argument
+func fileArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errUsage
+	}
+	path, err := absPath(args[0])
+	if err != nil {
+		return "", fmt.Errorf("resolution failed: %w", err)
+	}
+	return path, nil
+}
+
+// optionalFileArg is fileArg for commands of the file or all files,
+// which return the empty path without an argument
+func optionalFileArg(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	return fileArg(args)
+}
+
+func noArgs(args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	return nil
+}
+
+// workingCopy checks that the file exists, for the commands that need
+// it. The history of a deleted file can still be read.
+func workingCopy(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("read failed: %w", err)
+	}
+	return nil
+}
+
+func parseOptionalDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return parseDate(s)
+}
+
+func cmdAdd(idx *index, fs *flag.FlagSet, args []string) error {
+	msg := stringFlag(fs, "m")
+	if name := stringFlag(fs, "add-file"); name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if msg = strings.TrimSpace(string(data)); msg == "" {
+			return fmt.Errorf("empty message in %s, nothing committed", name)
+		}
+	}
+	// without a message it is composed in the editor
+	compose := msg == ""
+	stdin := boolFlag(fs, "stdin")
+	if compose && stdin {
+		return usageError("-stdin needs a -m message")
+	}
+	if when := stringFlag(fs, "when"); when != "" {
+		var err error
+		if commitTime, err = parseDate(when); err != nil {
+			return err
+		}
+		if commitTime.After(time.Now()) {
+			return fmt.Errorf("cannot commit in the future, %s", when)
+		}
+	}
+
+	// many files or a glob commits each file, based on its latest version
+	list := stringFlag(fs, "files")
+	if !stdin && (len(args) > 1 || len(args) == 1 && isGlob(args[0]) || list != "") {
+		if compose || isSet(fs, "base") || list != "" && len(args) > 0 {
+			return errUsage
+		}
+		if list != "" {
+			in := os.Stdin
+			if list != "-" {
+				var err error
+				if in, err = os.Open(list); err != nil {
+					return err
+				}
+			}
+			var err error
+			args, err = readPathList(in)
+			in.Close()
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("no files in %s", list)
+			}
+		}
+		paths, err := expandFiles(args)
+		if err != nil {
+			return err
+		}
+		if idx.addFiles(os.Stdout, paths, msg, boolFlag(fs, "force")) > 0 {
+			return exitCode(1)
+		}
+		return nil
+	}
+
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	// versions are based on the latest version unless -base sets
+	// another one, or 0 for a new root
+	base := idx.currVersion(path)
+	if isSet(fs, "base") {
+		base = intFlag(fs, "base")
+	}
+	force := boolFlag(fs, "force")
+
+	if stdin {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if v := idx.currVersion(path); v > 0 && !force {
+			stored, err := idx.extract(path, v)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(data, stored) {
+				fmt.Fprintf(os.Stderr, "%s is unchanged since version %d, nothing committed, use -force to commit it\n", path, v)
+				return nil
+			}
+		}
+		return idx.commitReader(path, bytes.NewReader(data), base, msg, commitMeta)
+	}
+
+	if err := workingCopy(path); err != nil {
+		return err
+	}
+	if v := idx.currVersion(path); v > 0 && !force {
+		cmt, err := idx.lookup(path, v)
+		if err != nil {
+			return err
+		}
+		if same, err := idx.unchanged(path, cmt); err != nil {
+			return err
+		} else if same {
+			fmt.Fprintf(os.Stderr, "%s is unchanged since version %d, nothing committed, use -force to commit it\n", path, v)
+			return nil
+		}
+	}
+	if compose {
+		if msg, err = idx.composeMessage(path, base); err != nil {
+			return err
+		}
+		if msg == "" {
+			return errors.New("empty message, nothing committed")
+		}
+	}
+	return idx.commit(path, base, msg, commitMeta)
+}
+
+func cmdLog(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	for _, cmt := range idx.filter(path) {
+		if cmt.hasMeta(commitMeta) {
+			printCommit(cmt)
+		}
+	}
+	return nil
+}
+
+func cmdSearch(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	words := strings.ToLower(stringFlag(fs, "message"))
+	for _, cmt := range idx.filter(path) {
+		if strings.Contains(strings.ToLower(cmt.message()), words) && cmt.hasMeta(commitMeta) {
+			printCommit(cmt)
+		}
+	}
+	return nil
+}
+
+func cmdQuery(idx *index, fs *flag.FlagSet, args []string) error {
+	expr, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	q, err := parseQuery(expr)
+	if err != nil {
+		return err
+	}
+	for _, cmt := range idx.filter(path) {
+		if q(cmt) {
+			printCommit(cmt)
+		}
+	}
+	return nil
+}
+
+func cmdTree(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	dummy := idx.treeOfCommits(path)
+	for _, cmt := range dummy.descs {
+		treePrint(cmt, 0, boolFlag(fs, "full"))
+	}
+	return nil
+}
+
+func cmdBranches(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	idx.printBranches(os.Stdout, path)
+	return nil
+}
+
+func cmdList(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	m := make(map[string]string)
+	for _, cmt := range idx.commits {
+		m[cmt.path] = cmt.pathSig
+	}
+	s := make([]string, 0, len(m))
+	for path := range m {
+		s = append(s, path)
+	}
+	slices.Sort(s)
+	for _, path := range s {
+		fmt.Println(path, "\t", m[path])
+	}
+	return nil
+}
+
+func cmdTimeline(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	since, err := parseOptionalDate(stringFlag(fs, "since"))
+	if err != nil {
+		return err
+	}
+	until, err := parseOptionalDate(stringFlag(fs, "until"))
+	if err != nil {
+		return err
+	}
+	times := orderedTimes(idx.commits)
+	var commits []*commit
+	for _, cmt := range idx.commits {
+		if !since.IsZero() && times[cmt].Before(since) || !until.IsZero() && !times[cmt].Before(until) {
+			continue
+		}
+		if cmt.hasMeta(commitMeta) {
+			commits = append(commits, cmt)
+		}
+	}
+	// times have second precision, versions order commits of the same second
+	slices.SortFunc(commits, func(a, b *commit) int {
+		if c := times[a].Compare(times[b]); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return a.version - b.version
+	})
+	for _, cmt := range commits {
+		printCommit(cmt)
+	}
+	return nil
+}
+
+func cmdStatus(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	status, code, err := idx.status(path)
+	if err != nil {
+		return err
+	}
+	fmt.Println(status)
+	if code != 0 {
+		return exitCode(code)
+	}
+	return nil
+}
+
+func cmdCat(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	version := idx.versionOrLatest(path, intFlag(fs, "version"))
+	w := bufio.NewWriter(os.Stdout)
+	var out io.Writer = w
+	if lines := stringFlag(fs, "lines"); lines != "" {
+		from, to, err := parseRange(strings.Replace(lines, ",", "..", 1))
+		if err != nil {
+			return fmt.Errorf("invalid -lines %q", lines)
+		}
+		out = &lineRange{w: w, from: from, to: to, line: 1}
+	}
+	if err := idx.extractTo(out, path, version); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func cmdGrep(idx *index, fs *flag.FlagSet, args []string) error {
+	pattern, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	matches, err := idx.grep(os.Stdout, path, idx.versionOrLatest(path, intFlag(fs, "version")), re)
+	if err != nil {
+		return err
+	}
+	if matches == 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func diffFlags(fs *flag.FlagSet) diffOptions {
+	return diffOptions{raw: boolFlag(fs, "raw"), imgdiff: stringFlag(fs, "imgdiff"), key: intFlag(fs, "key")}
+}
+
+func cmdDiff(idx *index, fs *flag.FlagSet, args []string) error {
+	opts := diffFlags(fs)
+	if boolFlag(fs, "all") {
+		if err := noArgs(args); err != nil {
+			return err
+		}
+		if err := idx.diffAll(os.Stdout, opts); err != nil {
+			return fmt.Errorf("failed to diff: %w", err)
+		}
+		return nil
+	}
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	from, to := intFlag(fs, "from"), intFlag(fs, "to")
+	if from == 0 || to == 0 {
+		if err := workingCopy(path); err != nil {
+			return err
+		}
+	}
+	if err := idx.diffFile(os.Stdout, path, from, to, opts); err != nil {
+		return fmt.Errorf("failed to diff: %w", err)
+	}
+	return nil
+}
+
+func cmdHistoryDiff(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	dir := ""
+	if isSet(fs, "o") {
+		dir = stringFlag(fs, "o")
+	}
+	if err := idx.historyDiff(os.Stdout, path, diffFlags(fs), dir); err != nil {
+		return fmt.Errorf("failed to diff: %w", err)
+	}
+	return nil
+}
+
+func cmdRestore(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	version := idx.versionOrLatest(path, intFlag(fs, "version"))
+	if boolFlag(fs, "save-current") {
+		if u, err := idx.uncommitted(path); err != nil {
+			return err
+		} else if u {
+			if err := idx.commitLatest(path, fmt.Sprintf("before restore of version %d", version)); err != nil {
+				return fmt.Errorf("failed to save the current contents: %w", err)
+			}
+			fmt.Printf("saved the current contents as version %d\n", idx.currVersion(path))
+		}
+	}
+	restore := idx.restore
+	if boolFlag(fs, "link") {
+		restore = idx.restoreLinked
+	}
+	if err := restore(path, version); err != nil {
+		return fmt.Errorf("failed to restore version %d: %w", version, err)
+	}
+	return nil
+}
+
+func cmdExport(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	dir := stringFlag(fs, "o")
+	if r := stringFlag(fs, "range"); r != "" {
+		from, to, err := parseRange(r)
+		if err != nil {
+			return err
+		}
+		commits := slices.Clone(idx.filter(path))
+		slices.Reverse(commits)
+		exported := 0
+		for _, cmt := range commits {
+			if cmt.version < from || cmt.version > to {
+				continue
+			}
+			fname, err := idx.export(path, cmt.version, dir)
+			if err != nil {
+				return fmt.Errorf("failed to export: %w", err)
+			}
+			fmt.Println(fname)
+			exported++
+		}
+		if exported == 0 {
+			return fmt.Errorf("no versions of %s in %s", path, r)
+		}
+		return nil
+	}
+
+	version := intFlag(fs, "version")
+	if version == 0 {
+		if version = idx.currVersion(path); version == 0 {
+			return fmt.Errorf("no versions for %s", path)
+		}
+	}
+	fname, err := idx.export(path, version, dir)
+	if err != nil {
+		return fmt.Errorf("failed to export: %w", err)
+	}
+	fmt.Println(fname)
+	return nil
+}
+
+func cmdExportGit(idx *index, fs *flag.FlagSet, args []string) error {
+	dir, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	root, err := absPath(dir)
+	if err != nil {
+		return fmt.Errorf("resolution failed: %w", err)
+	}
+	return idx.exportGit(os.Stdout, root)
+}
+
+func cmdImportGit(idx *index, fs *flag.FlagSet, args []string) error {
+	dir, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errUsage
+	}
+	root, err := absPath(dir)
+	if err != nil {
+		return fmt.Errorf("resolution failed: %w", err)
+	}
+	paths, err := expandFiles(args)
+	if err != nil {
+		return err
+	}
+	return idx.importGit(os.Stdout, root, paths)
+}
+
+func cmdExportScript(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	if err := idx.exportScript(os.Stdout, path); err != nil {
+		return fmt.Errorf("failed to export script: %w", err)
+	}
+	return nil
+}
+
+func cmdEdit(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	return idx.edit(path)
+}
+
+func cmdRun(idx *index, fs *flag.FlagSet, args []string) error {
+	msg, err := message(fs)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 || args[1] != "--" {
+		return errUsage
+	}
+	path, err := absPath(args[0])
+	if err != nil {
+		return fmt.Errorf("resolution failed: %w", err)
+	}
+	if code, err := idx.run(path, msg, args[2:]); err != nil {
+		log.Print(err)
+		return exitCode(code)
+	}
+	return nil
+}
+
+func cmdAmend(idx *index, fs *flag.FlagSet, args []string) error {
+	msg, err := message(fs)
+	if err != nil {
+		return err
+	}
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	return idx.amend(path, idx.versionOrLatest(path, intFlag(fs, "version")), msg)
+}
+
+func cmdUndo(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	version := idx.currVersion(path)
+	id, err := idx.uncommit(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "moved version %d of %s to the trash, restore it with sgvc trash restore %s\n", version, path, id)
+	return nil
+}
+
+func cmdMove(idx *index, fs *flag.FlagSet, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	oldPath, err := absPath(args[0])
+	if err != nil {
+		return fmt.Errorf("resolution failed: %w", err)
+	}
+	newPath, err := absPath(args[1])
+	if err != nil {
+		return fmt.Errorf("resolution failed: %w", err)
+	}
+	// like mv(1) unless the file was moved already
+	_, oldErr := os.Lstat(oldPath)
+	_, newErr := os.Lstat(newPath)
+	if err := idx.move(oldPath, newPath); err != nil {
+		return err
+	}
+	if oldErr == nil && errors.Is(newErr, os.ErrNotExist) {
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return fmt.Errorf("moved the history but not the file: %w", err)
+		}
+	}
+	return nil
+}
+
+func cmdForget(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	id, err := idx.forget(path, boolFlag(fs, "keep-blobs"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "moved the versions of %s to the trash, restore them with sgvc trash restore %s\n", path, id)
+	return nil
+}
+
+func cmdTrack(idx *index, fs *flag.FlagSet, args []string) error {
+	msg, err := message(fs)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errUsage
+	}
+	paths, err := idx.trackable(args)
+	if err != nil {
+		return err
+	}
+	tracked, failed := idx.track(paths, msg)
+	for _, path := range tracked {
+		fmt.Println(path)
+	}
+	if failed > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdSnapshot(idx *index, fs *flag.FlagSet, args []string) error {
+	msg, err := message(fs)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	if idx.snapshot(os.Stdout, msg) > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdPrepare(idx *index, fs *flag.FlagSet, args []string) error {
+	msg, err := message(fs)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errUsage
+	}
+	paths, err := expandFiles(args)
+	if err != nil {
+		return err
+	}
+	id, err := idx.prepare(paths, msg)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+func cmdFinalize(idx *index, fs *flag.FlagSet, args []string) error {
+	id, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	return idx.finalize(id)
+}
+
+func cmdAbort(idx *index, fs *flag.FlagSet, args []string) error {
+	id, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	return idx.abort(id)
+}
+
+func cmdLabel(idx *index, fs *flag.FlagSet, args []string) error {
+	name, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, arg := range args {
+		path, err := absPath(arg)
+		if err != nil {
+			return fmt.Errorf("resolution failed: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		paths = idx.paths()
+	}
+	if err := idx.addLabel(name, paths); err != nil {
+		return fmt.Errorf("failed to label: %w", err)
+	}
+	return nil
+}
+
+func cmdLabels(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return err
+	}
+	for _, l := range labels {
+		fmt.Printf("%s\t%s\t%0*d\n", l.name, l.path, versionWidth, l.version)
+	}
+	return nil
+}
+
+func cmdRestoreLabel(idx *index, fs *flag.FlagSet, args []string) error {
+	name, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	labels, err := idx.labelled(name)
+	if err != nil {
+		return err
+	}
+	failed := false
+	restore := idx.restore
+	if boolFlag(fs, "link") {
+		restore = idx.restoreLinked
+	}
+	for _, l := range labels {
+		if err := restore(l.path, l.version); err != nil {
+			log.Printf("failed to restore %s: %v", l.path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s\t%0*d\n", l.path, versionWidth, l.version)
+	}
+	if failed {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdCheckoutAll(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	if !isSet(fs, "o") {
+		return usageError("missing -o directory")
+	}
+	at, err := parseOptionalDate(stringFlag(fs, "at"))
+	if err != nil {
+		return err
+	}
+	failed, err := idx.checkoutAll(os.Stdout, stringFlag(fs, "o"), at, stringFlag(fs, "label"), nil)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdEnv(idx *index, fs *flag.FlagSet, args []string) error {
+	// the paths are the arguments before the first --, if any,
+	// the command all the arguments after it
+	command := args
+	args = nil
+	if i := slices.Index(command, "--"); i >= 0 {
+		args, command = command[:i], command[i+1:]
+	}
+	if len(command) == 0 {
+		return usageError("missing command")
+	}
+	var paths []string
+	for _, arg := range args {
+		path, err := absPath(arg)
+		if err != nil {
+			return fmt.Errorf("resolution failed: %w", err)
+		}
+		if !slices.ContainsFunc(idx.commits, func(cmt *commit) bool { return inPath(cmt.path, path) }) {
+			return fmt.Errorf("%s: no tracked files", path)
+		}
+		paths = append(paths, path)
+	}
+	at, err := parseOptionalDate(stringFlag(fs, "at"))
+	if err != nil {
+		return err
+	}
+	if code, err := idx.runAt(at, stringFlag(fs, "label"), paths, command); err != nil {
+		log.Print(err)
+		return exitCode(code)
+	}
+	return nil
+}
+
+func cmdIdentify(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	if err := workingCopy(path); err != nil {
+		return err
+	}
+	matches, err := idx.identify(path)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if cmt, err := idx.lookup(path, idx.currVersion(path)); err == nil && idx.replaced(path, fi, cmt) {
+			fmt.Printf("file was replaced by another file since version %0*d\n", versionWidth, cmt.version)
+		}
+	}
+	if len(matches) == 0 {
+		fmt.Println("no version matches", path)
+		return exitCode(1)
+	}
+	for _, cmt := range matches {
+		fmt.Printf("%0*d\t%s\t%s\n", versionWidth, cmt.version, cmt.when.Format(time.RFC3339), cmt.changes)
+	}
+	return nil
+}
+
+func cmdAssert(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	if err := workingCopy(path); err != nil {
+		return err
+	}
+	v := idx.versionOrLatest(path, intFlag(fs, "version"))
+	stored, err := idx.extract(path, v)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, stored) {
+		return fmt.Errorf("%s differs from version %0*d", path, versionWidth, v)
+	}
+	return nil
+}
+
+func cmdWhich(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	v := idx.versionOrLatest(path, intFlag(fs, "version"))
+	cmt, err := idx.lookup(path, v)
+	if err != nil {
+		return err
+	}
+	if err := idx.extractTo(io.Discard, path, v); err != nil {
+		return err
+	}
+	if cmt.encoding != "" {
+		return fmt.Errorf("version %d of %s is stored encoded, %s, use cat", v, path, cmt.encoding)
+	}
+	fmt.Println(idx.filePath(cmt))
+	return nil
+}
+
+func cmdFindHash(idx *index, fs *flag.FlagSet, args []string) error {
+	sum, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	matches, err := idx.findHash(sum)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return exitCode(1)
+	}
+	for _, cmt := range matches {
+		printCommit(cmt)
+	}
+	return nil
+}
+
+func cmdPinRef(idx *index, fs *flag.FlagSet, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	path, err := absPath(args[0])
+	if err != nil {
+		return fmt.Errorf("resolution failed: %w", err)
+	}
+	return idx.pinRef(path, idx.versionOrLatest(path, intFlag(fs, "version")), args[1])
+}
+
+func cmdFindRef(idx *index, fs *flag.FlagSet, args []string) error {
+	ref, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	commits, err := idx.pinned(ref)
+	if err != nil {
+		return err
+	}
+	for _, cmt := range commits {
+		printCommit(cmt)
+	}
+	return nil
+}
+
+func cmdRefs(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	refs, err := idx.loadRefs()
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if path == "" || r.path == path {
+			fmt.Printf("%s\t%s\t%0*d\n", r.id, r.path, versionWidth, r.version)
+		}
+	}
+	return nil
+}
+
+func cmdStats(idx *index, fs *flag.FlagSet, args []string) error {
+	if boolFlag(fs, "growth") {
+		path, err := optionalFileArg(args)
+		if err != nil {
+			return err
+		}
+		return idx.growth(os.Stdout, idx.filter(path))
+	}
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	commits := idx.filter(path)
+	var prevWords, prevLines, prevBytes int
+	for i := len(commits) - 1; i >= 0; i-- {
+		cmt := commits[i]
+		data, err := idx.extract(cmt.path, cmt.version)
+		if err != nil {
+			return err
+		}
+		words, lines := textStats(data)
+		fmt.Printf("%0*d\t%s\t%d words (%+d)\t%d lines (%+d)\t%d bytes (%+d)\n",
+			versionWidth, cmt.version, cmt.when.Format(time.RFC3339),
+			words, words-prevWords, lines, lines-prevLines, len(data), len(data)-prevBytes)
+		prevWords, prevLines, prevBytes = words, lines, len(data)
+	}
+	return nil
+}
+
+func cmdReport(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	fname, err := idx.report(path, stringFlag(fs, "o"))
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	fmt.Println(fname)
+	return nil
+}
+
+func cmdVerify(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := fileArg(args)
+	if err != nil {
+		return err
+	}
+	commits := idx.filter(path)
+	if len(commits) == 0 {
+		return fmt.Errorf("no versions for %s", path)
+	}
+	problems := idx.verify(path)
+	idx.logEvent("verify", path, 0, fmt.Sprintf("%d problems", len(problems)))
+	for _, p := range problems {
+		fmt.Println(p)
+		idx.logEvent("verify-failed", path, 0, p)
+	}
+	if len(problems) > 0 {
+		return exitCode(1)
+	}
+	fmt.Printf("%d versions ok\n", len(commits))
+	return nil
+}
+
+func cmdHeal(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	lost, err := idx.heal(os.Stdout, idx.filter(path))
+	if err != nil {
+		return err
+	}
+	// every version was verified, of the file or all files
+	idx.logEvent("verify", path, 0, fmt.Sprintf("heal, %d lost", lost))
+	if lost > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdManifest(idx *index, fs *flag.FlagSet, args []string) error {
+	if !boolFlag(fs, "verify") {
+		path, err := optionalFileArg(args)
+		if err != nil {
+			return err
+		}
+		return idx.printManifest(os.Stdout, idx.filter(path))
+	}
+	if len(args) != 1 {
+		return errUsage
+	}
+	r := io.Reader(os.Stdin)
+	if args[0] != "-" {
+		fin, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fin.Close()
+		r = fin
+	}
+	problems, err := idx.verifyManifest(os.Stdout, r)
+	if err != nil {
+		return err
+	}
+	if problems > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdDedupe(idx *index, fs *flag.FlagSet, args []string) error {
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	saved, err := idx.dedupe(os.Stdout, idx.filter(path))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes can be saved\n", saved)
+	return nil
+}
+
+func cmdCompact(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	backup, err := idx.compact()
+	if err != nil {
+		return fmt.Errorf("failed to compact index: %w", err)
+	}
+	fmt.Println("old index saved in", backup)
+	return nil
+}
+
+func cmdRenames(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	renames, err := idx.renames()
+	if err != nil {
+		return err
+	}
+	for _, r := range renames {
+		if !boolFlag(fs, "auto-follow") {
+			fmt.Printf("%s -> %s\n", r.from, r.to)
+			continue
+		}
+		if err := idx.move(r.from, r.to); err != nil {
+			return fmt.Errorf("failed to move %s: %w", r.from, err)
+		}
+		fmt.Printf("moved %s -> %s\n", r.from, r.to)
+	}
+	return nil
+}
+
+func cmdDiffStore(idx *index, fs *flag.FlagSet, args []string) error {
+	dir, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	path, err := optionalFileArg(args)
+	if err != nil {
+		return err
+	}
+	other, err := openStore(dir)
+	if err != nil {
+		return err
+	}
+	if diffStores(os.Stdout, idx, other, path) > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdMirror(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	dir := mirrorDir()
+	if dir == "" {
+		return errors.New("no mirror in the configuration")
+	}
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	// reload, the index may have changed before locking
+	err := idx.loadCommits()
+	if err == nil {
+		err = idx.mirror(dir)
+	}
+	idx.unlock()
+	if err != nil {
+		return fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return nil
+}
+
+func cmdBackup(idx *index, fs *flag.FlagSet, args []string) error {
+	fname, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	id, err := idx.backup(fname, stringFlag(fs, "since"))
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "checkpoint", id)
+	return nil
+}
+
+func cmdLinkLatest(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	if err := idx.refreshLatest(); err != nil {
+		return fmt.Errorf("failed to link latest versions: %w", err)
+	}
+	fmt.Println(idx.latestDir())
+	return nil
+}
+
+func cmdTrash(idx *index, fs *flag.FlagSet, args []string) error {
+	action, args, err := firstArg(args)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "list":
+		if err := noArgs(args); err != nil {
+			return err
+		}
+		trash, err := idx.loadTrash()
+		if err != nil {
+			return err
+		}
+		for _, te := range trash {
+			fmt.Printf("%s\t%s\t%s\n", te.id, te.when.Format(time.RFC3339), te.reason)
+			for _, cmt := range te.commits {
+				fmt.Printf("\t%s\t%0*d\t%s\n", cmt.path, versionWidth, cmt.version, cmt.changes)
+			}
+			for _, l := range te.labels {
+				fmt.Printf("\t%s\t%0*d\tlabel %s\n", l.path, versionWidth, l.version, l.name)
+			}
+			for _, r := range te.refs {
+				fmt.Printf("\t%s\t%0*d\tref %s\n", r.path, versionWidth, r.version, r.id)
+			}
+		}
+	case "empty":
+		if err := noArgs(args); err != nil {
+			return err
+		}
+		if err := idx.lock(); err != nil {
+			return err
+		}
+		err := idx.emptyTrash(true)
+		idx.unlock()
+		if err != nil {
+			return fmt.Errorf("failed to empty trash: %w", err)
+		}
+	case "restore":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return idx.restoreTrash(args[0])
+	default:
+		return usageError("unknown action " + action)
+	}
+	return nil
+}
+
+func cmdEvents(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	return idx.printEvents(os.Stdout, boolFlag(fs, "follow"))
+}
+
+func cmdInfo(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	h, err := idx.health()
+	if err != nil {
+		return err
+	}
+	h.print(os.Stdout)
+	if boolFlag(fs, "check") && h.check(os.Stdout) > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdDoctor(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	if idx.doctor(os.Stdout) > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+func cmdLockStatus(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	return idx.lockStatus(os.Stdout)
+}
+
+func cmdBreakLock(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	return idx.breakLock()
+}
+
+func cmdPrompt(idx *index, fs *flag.FlagSet, args []string) error {
+	if err := noArgs(args); err != nil {
+		return err
+	}
+	if s := idx.prompt(); s != "" {
+		fmt.Println(s)
+	}
+	return nil
+}
+
+// lookupCommand returns the command with the name, or nil
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseCommandLine returns the command of the command line, its parsed
+// flags and its arguments. The flags of older versions are translated
+// to the command they select.
+func parseCommandLine() (*command, *flag.FlagSet, []string) {
+	var name string
+	var args []string
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		flag.Parse()
+		name, args = legacyCommandLine()
+	} else {
+		name, args = os.Args[1], os.Args[2:]
+		if name == "help" {
+			if len(args) == 1 && lookupCommand(args[0]) != nil {
+				name, args = args[0], []string{"-h"}
+			} else {
+				usage()
+			}
+		}
+	}
+	c := lookupCommand(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", name)
+		usage()
+	}
+	fs := c.flagSet()
+	fs.Parse(args)
+	rest := fs.Args()
+	// env splits its arguments at the first --, the parser drops
+	// the one that ends the flags
+	if c.name == "env" && dashDropped(args, rest) {
+		rest = append([]string{"--"}, rest...)
+	}
+	return c, fs, rest
+}
+
+// dashDropped reports whether the parser of args dropped a -- that
+// ended the flags before the remaining arguments
+func dashDropped(args, rest []string) bool {
+	n := len(args) - len(rest)
+	return n > 0 && args[n-1] == "--"
+}
+
+// how the value of a flag of older versions is passed to its command
+const (
+	legacySwitch  = iota // the flag only selects the command
+	legacyArg            // the value is the first argument
+	legacyMessage        // the value is the -m message
+	legacyVersion        // the value is the -version
+)
+
+// legacyFlags are the flags of older versions that select a command, in
+// the order main checked them
+var legacyFlags = []struct {
+	flag, command string
+	mode          int
+}{
+	{"run", "run", legacyMessage},
+	{"mv", "mv", legacySwitch},
+	{"pin-ref", "pin-ref", legacyVersion},
+	{"env", "env", legacySwitch},
+	{"trash", "trash", legacyArg},
+	{"prepare", "prepare", legacyMessage},
+	{"add", "add", legacyMessage},
+	{"add-file", "add", legacySwitch},
+	{"track", "track", legacyMessage},
+	{"import-git", "import-git", legacyArg},
+	{"checkout-all", "checkout-all", legacySwitch},
+	{"label", "label", legacyArg},
+	{"renames", "renames", legacySwitch},
+	{"link-latest", "link-latest", legacySwitch},
+	{"mirror", "mirror", legacySwitch},
+	{"prompt", "prompt", legacySwitch},
+	{"timeline", "timeline", legacySwitch},
+	{"snapshot", "snapshot", legacyMessage},
+	{"finalize", "finalize", legacyArg},
+	{"backup", "backup", legacyArg},
+	{"abort", "abort", legacyArg},
+	{"info", "info", legacySwitch},
+	{"events", "events", legacySwitch},
+	{"find-ref", "find-ref", legacyArg},
+	{"refs", "refs", legacySwitch},
+	{"find-hash", "find-hash", legacyArg},
+	{"doctor", "doctor", legacySwitch},
+	{"lock-status", "lock-status", legacySwitch},
+	{"break-lock", "break-lock", legacySwitch},
+	{"export-git", "export-git", legacyArg},
+	{"labels", "labels", legacySwitch},
+	{"restore-label", "restore-label", legacyArg},
+	{"list", "list", legacySwitch},
+	{"export-script", "export-script", legacySwitch},
+	{"diff-store", "diff-store", legacyArg},
+	{"commits", "log", legacySwitch},
+	{"search", "search", legacySwitch},
+	{"query", "query", legacyArg},
+	{"tree", "tree", legacySwitch},
+	{"branches", "branches", legacySwitch},
+	{"compact", "compact", legacySwitch},
+	{"manifest", "manifest", legacySwitch},
+	{"dedupe", "dedupe", legacySwitch},
+	{"verify", "verify", legacySwitch},
+	{"range", "export", legacySwitch},
+	{"export", "export", legacyVersion},
+	{"heal", "heal", legacySwitch},
+	{"identify", "identify", legacySwitch},
+	{"stats", "stats", legacySwitch},
+	{"report", "report", legacySwitch},
+	{"which", "which", legacySwitch},
+	{"forget", "forget", legacySwitch},
+	{"amend", "amend", legacyMessage},
+	{"undo", "undo", legacySwitch},
+	{"edit", "edit", legacySwitch},
+	{"assert", "assert", legacySwitch},
+	{"grep", "grep", legacyArg},
+	{"status", "status", legacySwitch},
+	{"restore", "restore", legacyVersion},
+	{"cat", "cat", legacyVersion},
+	{"lines", "cat", legacySwitch},
+	{"history-diff", "history-diff", legacySwitch},
+	{"diff", "diff", legacySwitch},
+}
+
+// legacyCommandLine returns the command selected by the parsed flags of
+// older versions and its command line: the flags of main that apply to
+// the command and the arguments of main.
+func legacyCommandLine() (string, []string) {
+	set := make(map[string]*flag.Flag)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = f
+	})
+	for _, l := range legacyFlags {
+		f := set[l.flag]
+		if f == nil {
+			continue
+		}
+		// -add with an empty message composes it in the editor
+		switch v := f.Value.(flag.Getter).Get().(type) {
+		case bool:
+			if !v {
+				continue
+			}
+		case string:
+			if v == "" && f.Name != "add" {
+				continue
+			}
+		}
+		c := lookupCommand(l.command)
+		value := f.Value.String()
+		var argv []string
+		if l.mode == legacyMessage && value != "" {
+			argv = append(argv, "-m", value)
+		}
+		// repeated flags, like -meta, were set by the parser already
+		for _, name := range append(c.flags, "progress-fd") {
+			if g, ok := set[name]; ok {
+				if _, ok := g.Value.(flag.Getter); ok {
+					argv = append(argv, "-"+name+"="+g.Value.String())
+				}
+			}
+		}
+		if l.mode == legacyVersion && value != "0" {
+			argv = append(argv, "-version="+value)
+		}
+		// the -- keeps the arguments arguments, and tells env
+		// that a -- ended the flags
+		if l.mode == legacyArg || dashDropped(os.Args[1:], flag.Args()) {
+			argv = append(argv, "--")
+		}
+		if l.mode == legacyArg {
+			argv = append(argv, value)
+		}
+		return c.name, append(argv, flag.Args()...)
+	}
+	usage()
+	return "", nil
+}
+
+// printCommands prints the commands and their descriptions
+func printCommands() {
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.help)
+	}
+}
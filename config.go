@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// config is the user configuration. It is read from the file sgvc/config
+// in os.UserConfigDir. Every line is
+//
+//	key = value
+//
+// or, for settings that apply only to the files matching a pattern
+// of filepath.Match,
+//
+//	key pattern = value
+//
+// A pattern without a / matches the file name, like *.iso.
+// Empty lines and lines starting with # are ignored.
+type config struct {
+	entries []configEntry
+}
+
+type configEntry struct {
+	key     string
+	pattern string // empty if the entry applies to all files
+	value   string
+}
+
+// conf is the configuration, loaded by main
+var conf = &config{}
+
+// configFile returns the path of the configuration file
+func configFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sgvc", "config"), nil
+}
+
+// loadConfig reads the configuration file. A missing file is an empty configuration.
+func loadConfig() (*config, error) {
+	fname, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+	fin, err := os.Open(fname)
+	if errors.Is(err, os.ErrNotExist) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	c := &config{}
+	nlines := 0
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		nlines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lhs, value, ok := strings.Cut(line, "=")
+		fields := strings.Fields(lhs)
+		if !ok || len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: malformed line", fname, nlines)
+		}
+		e := configEntry{key: fields[0], value: strings.TrimSpace(value)}
+		if len(fields) == 2 {
+			if _, err := filepath.Match(fields[1], ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: malformed pattern: %v", fname, nlines, err)
+			}
+			e.pattern = fields[1]
+		}
+		c.entries = append(c.entries, e)
+	}
+	return c, scanner.Err()
+}
+
+// matches reports whether the entry applies to the file
+func (e *configEntry) matches(path string) bool {
+	if e.pattern == "" {
+		return true
+	}
+	if !strings.Contains(e.pattern, "/") {
+		path = filepath.Base(path)
+	}
+	ok, _ := filepath.Match(e.pattern, path)
+	return ok
+}
+
+// get returns the value of the last setting of the key for all files
+func (c *config) get(key string) string {
+	value := ""
+	for _, e := range c.entries {
+		if e.key == key && e.pattern == "" {
+			value = e.value
+		}
+	}
+	return value
+}
+
+// values returns the values of all the settings of the key for all files
+func (c *config) values(key string) []string {
+	var values []string
+	for _, e := range c.entries {
+		if e.key == key && e.pattern == "" {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
+
+// getBool reports whether the key is set to true
+func (c *config) getBool(key string) bool {
+	v := c.get(key)
+	return v == "true" || v == "yes" || v == "1"
+}
+
+// allForPath returns the values of all the settings of the key
+// that apply to the file
+func (c *config) allForPath(key, path string) []string {
+	var values []string
+	for _, e := range c.entries {
+		if e.key != key {
+			continue
+		}
+		if !e.matches(path) {
+			continue
+		}
+		values = append(values, e.value)
+	}
+	return values
+}
+
+// forPath returns the value of the last setting of the key
+// that applies to the file
+func (c *config) forPath(key, path string) (string, bool) {
+	value, found := "", false
+	for _, e := range c.entries {
+		if e.key != key {
+			continue
+		}
+		if !e.matches(path) {
+			continue
+		}
+		value, found = e.value, true
+	}
+	return value, found
+}
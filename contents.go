@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// contentSum returns the hex sha256 and the size of the contents of the version
+func (idx *index) contentSum(cmt *commit) (string, int64, error) {
+	h, cw := newHash(hashSHA256), &countingWriter{}
+	if err := idx.extractTo(io.MultiWriter(h, cw), cmt.path, cmt.version); err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), cw.n, nil
+}
+
+// printManifest prints a line with the path, the version, the size and the
+// sha256 of every version of the commits, ordered by path and version.
+// The output is stable so that manifests of the same store can be compared.
+func (idx *index) printManifest(w io.Writer, commits []*commit) error {
+	commits = slices.Clone(commits)
+	slices.SortFunc(commits, func(a, b *commit) int {
+		if c := cmp.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.version, b.version)
+	})
+	bw := bufio.NewWriter(w)
+	for _, cmt := range commits {
+		sum, size, err := idx.contentSum(cmt)
+		if err != nil {
+			return fmt.Errorf("%s @%0*d: %w", cmt.path, versionWidth, cmt.version, err)
+		}
+		fmt.Fprintf(bw, "%s\t%0*d\t%d\t%s\n", cmt.path, versionWidth, cmt.version, size, sum)
+	}
+	return bw.Flush()
+}
+
+// verifyManifest checks the store against a manifest printed by printManifest.
+// It prints the versions of the manifest that are missing from the store or
+// have different contents, and the versions of the files of the manifest
+// that it does not list, and returns the number of missing or different versions.
+func (idx *index) verifyManifest(w io.Writer, r io.Reader) (int, error) {
+	type key struct {
+		path    string
+		version int
+	}
+	listed := make(map[key]bool)
+	problems := 0
+	scanner := bufio.NewScanner(r)
+	for nlines := 1; scanner.Scan(); nlines++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			return problems, fmt.Errorf("line %d: malformed manifest line", nlines)
+		}
+		version, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return problems, fmt.Errorf("line %d: malformed version", nlines)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return problems, fmt.Errorf("line %d: malformed size", nlines)
+		}
+		path := fields[0]
+		listed[key{path, version}] = true
+
+		cmt, err := idx.lookup(path, version)
+		if err != nil {
+			fmt.Fprintf(w, "missing\t%s @%0*d\n", path, versionWidth, version)
+			problems++
+			continue
+		}
+		sum, n, err := idx.contentSum(cmt)
+		if err != nil {
+			fmt.Fprintf(w, "damaged\t%s @%0*d: %v\n", path, versionWidth, version, err)
+			problems++
+		} else if n != size || sum != fields[3] {
+			fmt.Fprintf(w, "changed\t%s @%0*d\n", path, versionWidth, version)
+			problems++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return problems, err
+	}
+
+	paths := make(map[string]bool)
+	for k := range listed {
+		paths[k.path] = true
+	}
+	for _, cmt := range idx.commits {
+		if paths[cmt.path] && !listed[key{cmt.path, cmt.version}] {
+			fmt.Fprintf(w, "new\t%s @%0*d\n", cmt.path, versionWidth, cmt.version)
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// commitContext returns the environment of the commit as metadata, if
+// the context key of the configuration is set: the working directory,
+// the command line and the environment variables listed by context-env.
+func commitContext() map[string]string {
+	if !conf.getBool("context") {
+		return nil
+	}
+	ctx := make(map[string]string)
+	if wd, err := os.Getwd(); err == nil {
+		ctx["context.cwd"] = wd
+	}
+	args := make([]string, len(os.Args))
+	for i, arg := range os.Args {
+		args[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$*?;&|<>()") {
+			args[i] = shellQuote(arg)
+		}
+	}
+	ctx["context.cmdline"] = strings.Join(args, " ")
+	for _, name := range strings.Fields(conf.get("context-env")) {
+		if value, ok := os.LookupEnv(name); ok {
+			ctx["env."+name] = value
+		}
+	}
+	return ctx
+}
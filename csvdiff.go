@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// table is a parsed csv file. The first record is the header.
+type table struct {
+	header []string
+	rows   map[string][]string // rows by key column value
+	keys   []string            // keys in file order
+}
+
+// parseTable parses csv data keyed by column key (0-based)
+func parseTable(data []byte, comma rune, key int) (*table, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &table{rows: make(map[string][]string)}
+	if len(records) == 0 {
+		return t, nil
+	}
+	t.header = records[0]
+	if key >= len(t.header) {
+		return nil, fmt.Errorf("key column %d does not exist", key+1)
+	}
+	for i, rec := range records[1:] {
+		if key >= len(rec) {
+			return nil, fmt.Errorf("row %d has no key column", i+2)
+		}
+		k := rec[key]
+		if _, ok := t.rows[k]; ok {
+			return nil, fmt.Errorf("duplicate key %q in row %d", k, i+2)
+		}
+		t.rows[k] = rec
+		t.keys = append(t.keys, k)
+	}
+	return t, nil
+}
+
+// cell returns the value of the named column in the row
+func (t *table) cell(row []string, column string) (string, bool) {
+	for i, h := range t.header {
+		if h == column {
+			if i < len(row) {
+				return row[i], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// isTable reports whether the path should be diffed as a table
+func isTable(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".csv" || ext == ".tsv"
+}
+
+// tableDiff reports the added, removed and changed rows and columns
+// between two csv or tsv files. Rows are aligned on the key column (1-based).
+// Files with a missing key column, short rows or duplicate keys are
+// diffed line by line.
+func tableDiff(w io.Writer, path string, from, to []byte, labelFrom, labelTo string, key int) error {
+	comma := ','
+	if strings.ToLower(filepath.Ext(path)) == ".tsv" {
+		comma = '\t'
+	}
+	if key < 1 {
+		return fmt.Errorf("invalid key column %d", key)
+	}
+	// tables that cannot be aligned on the key are diffed line by line
+	tfrom, err := parseTable(from, comma, key-1)
+	if err != nil {
+		log.Printf("WARNING: %s: %v, diffing lines", labelFrom, err)
+		return diff(w, from, to, labelFrom, labelTo)
+	}
+	tto, err := parseTable(to, comma, key-1)
+	if err != nil {
+		log.Printf("WARNING: %s: %v, diffing lines", labelTo, err)
+		return diff(w, from, to, labelFrom, labelTo)
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", labelFrom, labelTo)
+	for _, h := range tfrom.header {
+		if _, ok := tto.cell(nil, h); !ok {
+			fmt.Fprintf(w, "-column %s\n", h)
+		}
+	}
+	for _, h := range tto.header {
+		if _, ok := tfrom.cell(nil, h); !ok {
+			fmt.Fprintf(w, "+column %s\n", h)
+		}
+	}
+	for _, k := range tfrom.keys {
+		if _, ok := tto.rows[k]; !ok {
+			fmt.Fprintf(w, "-row %s\n", k)
+		}
+	}
+	for _, k := range tto.keys {
+		rto := tto.rows[k]
+		rfrom, ok := tfrom.rows[k]
+		if !ok {
+			fmt.Fprintf(w, "+row %s\n", k)
+			continue
+		}
+		for _, h := range tto.header {
+			vfrom, ok := tfrom.cell(rfrom, h)
+			if !ok {
+				continue
+			}
+			if vto, _ := tto.cell(rto, h); vto != vfrom {
+				fmt.Fprintf(w, "~row %s: %s: %q -> %q\n", k, h, vfrom, vto)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// encodingDelta is the encoding of blobs of versions stored as the
+// compressed instructions that build them from another version of the
+// file, their delta base
+const encodingDelta = "delta"
+
+const (
+	// deltaBlock is the size of the blocks of the base found in the version
+	deltaBlock = 32
+	// maxDeltaChain is the most deltas read to build a version, the
+	// next version is stored compressed
+	maxDeltaChain = 16
+)
+
+// delta instructions, after the size of the version
+const (
+	deltaCopy   = 1 // offset and length of a range of the base
+	deltaInsert = 2 // length and bytes
+)
+
+// makeDelta returns the instructions that build data from base. Blocks of
+// base are found in data by a rolling hash and extended byte by byte.
+func makeDelta(base, data []byte) []byte {
+	const mult = 16777619
+	pow := uint32(1)
+	for i := 1; i < deltaBlock; i++ {
+		pow *= mult
+	}
+	hash := func(b []byte) uint32 {
+		var h uint32
+		for _, c := range b {
+			h = h*mult + uint32(c)
+		}
+		return h
+	}
+	blocks := make(map[uint32]int)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		h := hash(base[off : off+deltaBlock])
+		if _, ok := blocks[h]; !ok {
+			blocks[h] = off
+		}
+	}
+
+	delta := binary.AppendUvarint(nil, uint64(len(data)))
+	insert := func(b []byte) {
+		if len(b) > 0 {
+			delta = append(delta, deltaInsert)
+			delta = binary.AppendUvarint(delta, uint64(len(b)))
+			delta = append(delta, b...)
+		}
+	}
+	lit, i := 0, 0
+	var h uint32
+	if len(data) >= deltaBlock {
+		h = hash(data[:deltaBlock])
+	}
+	for i+deltaBlock <= len(data) {
+		if off, ok := blocks[h]; ok && bytes.Equal(base[off:off+deltaBlock], data[i:i+deltaBlock]) {
+			for i > lit && off > 0 && data[i-1] == base[off-1] {
+				i, off = i-1, off-1
+			}
+			n := deltaBlock
+			for i+n < len(data) && off+n < len(base) && data[i+n] == base[off+n] {
+				n++
+			}
+			insert(data[lit:i])
+			delta = append(delta, deltaCopy)
+			delta = binary.AppendUvarint(delta, uint64(off))
+			delta = binary.AppendUvarint(delta, uint64(n))
+			i += n
+			lit = i
+			if i+deltaBlock <= len(data) {
+				h = hash(data[i : i+deltaBlock])
+			}
+			continue
+		}
+		if i+deltaBlock < len(data) {
+			h = (h-uint32(data[i])*pow)*mult + uint32(data[i+deltaBlock])
+		}
+		i++
+	}
+	insert(data[lit:])
+	return delta
+}
+
+// applyDelta returns the data built from base by the delta instructions
+func applyDelta(base, delta []byte) ([]byte, error) {
+	errMalformed := errors.New("malformed delta")
+	r := bytes.NewReader(delta)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errMalformed
+	}
+	data := make([]byte, 0, size)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case deltaCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || off > uint64(len(base)) || n > uint64(len(base))-off {
+				return nil, errMalformed
+			}
+			data = append(data, base[off:off+n]...)
+		case deltaInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, errMalformed
+			}
+			start := len(delta) - r.Len()
+			data = append(data, delta[start:start+int(n)]...)
+			r.Seek(int64(n), 1)
+		default:
+			return nil, errMalformed
+		}
+	}
+	if uint64(len(data)) != size {
+		return nil, errMalformed
+	}
+	return data, nil
+}
+
+// deltaBase returns the commit of the version the pending version is
+// stored as a delta of, its base, and its contents. It returns nil if the
+// version is stored compressed instead: a new root, a base at the end of a
+// long chain of deltas or the hash layout, which stores identical contents once.
+func (idx *index) deltaBase(p *pending) (*commit, []byte) {
+	if p.basedOn == 0 || idx.manifest.layout == layoutHash {
+		return nil, nil
+	}
+	cmt, err := idx.lookup(p.path, p.basedOn)
+	if err != nil {
+		return nil, nil
+	}
+	for c, n := cmt, 1; c.encoding == encodingDelta; n++ {
+		if n == maxDeltaChain {
+			return nil, nil
+		}
+		if c, err = idx.lookup(c.path, c.delta); err != nil {
+			return nil, nil
+		}
+	}
+	base, err := idx.extract(cmt.path, cmt.version)
+	if err != nil {
+		return nil, nil
+	}
+	return cmt, base
+}
+
+// storeWhole stores compressed the versions of the commits that are
+// deltas of versions in removed, before those are removed from the index,
+// or all deltas if removed is nil. It returns the commits with the new ones
+// and the blobs to remove once nothing refers to them. It must be called
+// with the store locked.
+func (idx *index) storeWhole(commits []*commit, removed map[*commit]bool) ([]*commit, []string, error) {
+	commits = append([]*commit(nil), commits...)
+	var old []string
+	for i, cmt := range commits {
+		if cmt.encoding != encodingDelta {
+			continue
+		}
+		if base, err := idx.lookup(cmt.path, cmt.delta); err == nil && removed != nil && !removed[base] {
+			continue
+		}
+		data, err := idx.extract(cmt.path, cmt.version)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to store version %d of %s whole: %w", cmt.version, cmt.path, err)
+		}
+		c := *cmt
+		c.encoding, c.delta = encodingGzip, 0
+		if err := idx.writeBlob(&c, data); err != nil {
+			return nil, nil, fmt.Errorf("failed to store version %d of %s whole: %w", cmt.version, cmt.path, err)
+		}
+		commits[i] = &c
+		old = append(old, idx.filePath(cmt))
+	}
+	return commits, old, nil
+}
+
+// writeBlob writes the blob of the commit with the contents, encoded
+// like the commit records
+func (idx *index) writeBlob(cmt *commit, data []byte) error {
+	if cmt.encoding == encodingDelta {
+		base, err := idx.extract(cmt.path, cmt.delta)
+		if err != nil {
+			return err
+		}
+		data = makeDelta(base, data)
+	}
+	tmp, err := createTemp()
+	if err != nil {
+		return err
+	}
+	err = encodeBlob(tmp, data, cmt.encoding)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), blobMode)
+	}
+	if err == nil {
+		err = mkdirAll(filepath.Dir(idx.filePath(cmt)))
+	}
+	if err == nil {
+		// some systems do not replace read only files
+		os.Chmod(idx.filePath(cmt), fileMode)
+		err = os.Rename(tmp.Name(), idx.filePath(cmt))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
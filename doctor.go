@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// doctor checks the store and the environment for common problems and
+// prints them with a suggested fix. It returns the number of problems.
+func (idx *index) doctor(w io.Writer) int {
+	problems := 0
+	report := func(problem, fix string) {
+		fmt.Fprintf(w, "problem: %s\n    fix: %s\n", problem, fix)
+		problems++
+	}
+
+	// cache directories are cleaned by tools and sometimes by the OS
+	if cacheDir, err := os.UserCacheDir(); err == nil && strings.HasPrefix(idx.workDir, cacheDir+string(filepath.Separator)) {
+		report(fmt.Sprintf("store %s is in the cache directory, which cleaning tools may empty", idx.workDir),
+			"move it elsewhere and set store = <dir> in the configuration")
+	}
+	if tmp := os.TempDir(); strings.HasPrefix(idx.workDir, tmp+string(filepath.Separator)) {
+		report(fmt.Sprintf("store %s is in the temp directory, which is emptied on reboot", idx.workDir),
+			"move it elsewhere and set store = <dir> in the configuration")
+	}
+
+	if _, err := exec.LookPath("diff"); err != nil {
+		report("diff(1) is not in PATH, -diff cannot work", "install diffutils")
+	}
+
+	forbidden := os.FileMode(0077)
+	if conf.getBool("shared") {
+		forbidden = 0007
+	}
+	entries, err := os.ReadDir(idx.workDir)
+	if err != nil {
+		report(fmt.Sprintf("cannot read the store: %v", err), "check the permissions of "+idx.workDir)
+		return problems
+	}
+	stored, err := storeBlobs(idx.workDir, idx.manifest.layout)
+	if err != nil {
+		report(fmt.Sprintf("cannot read the store: %v", err), "check the permissions of "+idx.workDir)
+		return problems
+	}
+	badModes, writable, noSetgid := 0, 0, 0
+	// new files of a shared store belong to the group of setgid directories
+	setgid := func(fi os.FileInfo) {
+		if conf.getBool("shared") && fi.IsDir() && fi.Mode()&os.ModeSetgid == 0 {
+			noSetgid++
+		}
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err == nil && fi.Mode().Perm()&forbidden != 0 {
+			badModes++
+		}
+		if err == nil {
+			setgid(fi)
+		}
+	}
+	for _, name := range stored {
+		fi, err := os.Stat(filepath.Join(idx.workDir, name))
+		if err != nil {
+			continue
+		}
+		if perm := fi.Mode().Perm(); perm&forbidden != 0 {
+			// the entries of the store directory are counted above
+			if strings.ContainsRune(name, filepath.Separator) {
+				badModes++
+			}
+		} else if perm != blobMode {
+			writable++
+		}
+	}
+	if fi, err := os.Stat(idx.workDir); err == nil {
+		if fi.Mode().Perm()&forbidden != 0 {
+			badModes++
+		}
+		setgid(fi)
+	}
+	if badModes > 0 {
+		report(fmt.Sprintf("%d files of the store are accessible by other users", badModes),
+			"the doctor fixed the modes of your files, run it again to see the files of others")
+	}
+	if writable > 0 {
+		report(fmt.Sprintf("%d stored versions are not read only and may be altered by accident", writable),
+			"the doctor fixed the modes of your files, run it again to see the files of others")
+	}
+	if noSetgid > 0 {
+		report(fmt.Sprintf("%d directories of the shared store lack the setgid bit, their new files may not belong to the group of the store", noSetgid),
+			"the doctor fixed the modes of your directories, run it again to see the directories of others")
+	}
+	// other commands check only the store directory, the index and the manifest
+	if badModes > 0 || writable > 0 || noSetgid > 0 {
+		hardenStore(idx.workDir, idx.manifest.layout, true)
+	}
+
+	if h, err := idx.lockHolder(); err != nil {
+		report(err.Error(), "run sgvc -break-lock")
+	} else if h != nil && time.Since(h.since) > lockTimeout {
+		report("store is locked by "+h.String(), "if that process is not running, run sgvc -break-lock")
+	}
+
+	switch {
+	case idx.manifest.format > storeFormat:
+		report(fmt.Sprintf("store format %d is newer than %d of this sgvc, the store is read only", idx.manifest.format, storeFormat),
+			"upgrade sgvc to "+idx.manifest.writer+" or newer")
+	case idx.manifest.format < storeFormat:
+		report(fmt.Sprintf("store format %d is older than %d of this sgvc", idx.manifest.format, storeFormat),
+			"nothing, the store is upgraded by the next modification")
+	}
+
+	if n := len(idx.quarantined); n > 0 {
+		report(fmt.Sprintf("%d damaged index lines are quarantined", n),
+			"run sgvc -compact to move them to index.quarantine")
+	}
+
+	// a cheap check of the blobs, -verify checks the contents too
+	missing, wrongSize := 0, 0
+	for _, cmt := range idx.commits {
+		fi, err := os.Stat(idx.filePath(cmt))
+		if err != nil {
+			missing++
+		} else if !cmt.mtime.IsZero() && cmt.encoding == "" && fi.Size() != cmt.size {
+			wrongSize++
+		}
+	}
+	if missing > 0 || wrongSize > 0 {
+		report(fmt.Sprintf("%d stored versions are missing and %d have the wrong size", missing, wrongSize),
+			"run sgvc -heal to restore them from identical copies")
+	}
+	if orphans, err := idx.orphanBlobs(); err == nil && len(orphans) > 0 {
+		report(fmt.Sprintf("%d files in the store are not versions of any tracked file", len(orphans)),
+			"they may be left by interrupted commits or sgvc -forget -keep-blobs, remove them or keep them for forensics")
+	}
+
+	if problems == 0 {
+		fmt.Fprintln(w, "no problems found")
+	}
+	return problems
+}
+
+// isBlobName reports whether the file name has the form of a blob name,
+// a hex path signature followed by a dash and a version
+func isBlobName(name string) bool {
+	sig, rest, ok := strings.Cut(name, "-")
+	if !ok || sig == "" || rest == "" || rest[0] < '0' || rest[0] > '9' {
+		return false
+	}
+	return strings.Trim(sig, "0123456789abcdef") == ""
+}
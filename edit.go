@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// editor returns the command line of the user's editor
+func editor() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if args := strings.Fields(os.Getenv(env)); len(args) > 0 {
+			return args
+		}
+	}
+	return []string{"vi"}
+}
+
+// uncommitted reports whether the file exists and is not tracked
+// or differs from its latest version
+func (idx *index) uncommitted(path string) (bool, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	version := idx.currVersion(path)
+	if version == 0 {
+		return true, nil
+	}
+	cmt, err := idx.lookup(path, version)
+	if err != nil {
+		return false, err
+	}
+	return modified(path, cmt)
+}
+
+// commitLatest commits the file based on its latest version
+func (idx *index) commitLatest(path, message string) error {
+	if err := idx.commit(path, idx.currVersion(path), message, commitMeta); err != nil {
+		return err
+	}
+	return idx.loadCommits()
+}
+
+// edit commits the uncommitted changes of the file, opens it in the
+// editor and commits the changes made with a message read from stdin
+func (idx *index) edit(path string) error {
+	if u, err := idx.uncommitted(path); err != nil {
+		return err
+	} else if u {
+		if err := idx.commitLatest(path, "changes before edit"); err != nil {
+			return err
+		}
+	}
+
+	args := append(editor(), path)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor failed, nothing committed: %w", err)
+	}
+
+	if u, err := idx.uncommitted(path); err != nil || !u {
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "no changes")
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "message for %s: ", path)
+	message, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if message = strings.TrimSpace(message); message == "" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr)
+		}
+		message = "edited"
+	}
+	return idx.commitLatest(path, message)
+}
+
+// run commits the uncommitted changes of the file, runs the command and,
+// if it succeeds and changed the file, commits the file with the message.
+// The exit code of a failed command is returned with the error.
+func (idx *index) run(path, message string, command []string) (int, error) {
+	if u, err := idx.uncommitted(path); err != nil {
+		return 1, err
+	} else if u {
+		if err := idx.commitLatest(path, "changes before run"); err != nil {
+			return 1, err
+		}
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), fmt.Errorf("%s failed, nothing committed: %w", command[0], err)
+		}
+		return 1, err
+	}
+
+	if u, err := idx.uncommitted(path); err != nil || !u {
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	if err := idx.commitLatest(path, message); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// diffStat returns the numbers of lines added and removed in the file
+// since the version
+func (idx *index) diffStat(path string, version int) (added, removed int, err error) {
+	var buf bytes.Buffer
+	if err := idx.diffFile(&buf, path, version, 0, diffOptions{raw: true}); err != nil {
+		return 0, 0, err
+	}
+	hunks := false
+	for _, line := range strings.Split(buf.String(), "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			hunks = true
+		case !hunks:
+			// the --- and +++ labels
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	return added, removed, nil
+}
+
+// composeMessage opens the editor with a template of the commit of the
+// file based on the version and returns the message written. Lines
+// starting with # are ignored.
+func (idx *index) composeMessage(path string, basedOn int) (string, error) {
+	var tmpl strings.Builder
+	fmt.Fprintf(&tmpl, "\n# Message of the commit of %s\n", path)
+	if v := idx.currVersion(path); v == 0 {
+		fmt.Fprintf(&tmpl, "# version 1, the file is not tracked\n")
+	} else {
+		added, removed, err := idx.diffStat(path, v)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&tmpl, "# version %d based on %d, %d lines added and %d removed since version %d\n", v+1, basedOn, added, removed, v)
+	}
+	fmt.Fprintf(&tmpl, "# Lines starting with # are ignored, an empty message aborts the commit.\n")
+
+	fname, err := tempFile([]byte(tmpl.String()))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(fname)
+	args := append(editor(), fname)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor failed, nothing committed: %w", err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
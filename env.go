@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// envRoot is the environment variable with the directory of the files of
+// sgvc env
+const envRoot = "SGVC_ROOT"
+
+// inPath reports whether the file is the path or under the directory path
+func inPath(file, path string) bool {
+	return file == path || strings.HasPrefix(file, strings.TrimSuffix(path, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// runAt writes the versions of the tracked files in paths, or all files,
+// at the date or with the label, under a temp directory like -checkout-all,
+// runs the command with SGVC_ROOT set to the directory and removes it.
+// The exit code of a failed command is returned with the error.
+func (idx *index) runAt(at time.Time, label string, paths []string, command []string) (int, error) {
+	root, err := os.MkdirTemp("", "sgvc-env-")
+	if err != nil {
+		return 1, err
+	}
+	defer os.RemoveAll(root)
+
+	failed, err := idx.checkoutAll(io.Discard, root, at, label, paths)
+	if err != nil {
+		return 1, err
+	}
+	if failed > 0 {
+		return 1, fmt.Errorf("failed to write %d files, command not run", failed)
+	}
+
+	// the command handles interrupts, sgvc waits for it and cleans up
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), envRoot+"="+root)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), fmt.Errorf("%s failed: %w", command[0], err)
+		}
+		return 1, err
+	}
+	return 0, nil
+}
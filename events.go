@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// event is an entry of the operation log of the store
+type event struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path,omitempty"`
+	Version int       `json:"version,omitempty"`
+	User    string    `json:"user"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// eventsFile returns the path of the operation log, a file of json lines
+func (idx *index) eventsFile() string {
+	return filepath.Join(idx.workDir, "events")
+}
+
+// newEvent returns an event of the current user now
+func newEvent(op, path string, version int, detail string) event {
+	return event{
+		Time:    time.Now(),
+		Op:      op,
+		Path:    path,
+		Version: version,
+		User:    currentUser(),
+		Detail:  detail,
+	}
+}
+
+// logEvent appends an event to the operation log. The log is informative,
+// failures to write it are warnings.
+func (idx *index) logEvent(op, path string, version int, detail string) {
+	b, err := json.Marshal(newEvent(op, path, version, detail))
+	if err == nil {
+		err = appendLines(idx.eventsFile(), []string{string(b)})
+	}
+	if err != nil {
+		log.Printf("WARNING: failed to log %s event: %v", op, err)
+	}
+}
+
+// printEvents copies the operation log to w. If follow is set it
+// keeps copying new events as they are logged and never returns.
+func (idx *index) printEvents(w io.Writer, follow bool) error {
+	fin, err := os.Open(idx.eventsFile())
+	for errors.Is(err, os.ErrNotExist) && follow {
+		time.Sleep(500 * time.Millisecond)
+		fin, err = os.Open(idx.eventsFile())
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	// only complete lines are copied, the rest may still be written
+	r := bufio.NewReader(fin)
+	partial := ""
+	for {
+		line, err := r.ReadString('\n')
+		partial += line
+		if err == nil {
+			if _, err := io.WriteString(w, partial); err != nil {
+				return err
+			}
+			partial = ""
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
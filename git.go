@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitBranch is the branch of the histories exported to git
+const gitBranch = "refs/heads/sgvc"
+
+// exportGit writes a git fast-import(1) stream with the histories of the
+// tracked files under root, paths relative to it, like the repository of
+// etckeeper for /etc. Every version is a commit on the sgvc branch, in the
+// order of the commit times and of the versions of each file, with the
+// author and the time of the version.
+// The stream is imported with
+//
+//	sgvc -export-git /etc | git -C /etc fast-import
+func (idx *index) exportGit(w io.Writer, root string) error {
+	var commits []*commit
+	for _, cmt := range idx.commits {
+		if inPath(cmt.path, root) && cmt.path != root {
+			commits = append(commits, cmt)
+		}
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("no tracked files under %s", root)
+	}
+	times := orderedTimes(commits)
+	slices.SortFunc(commits, func(a, b *commit) int {
+		if c := times[a].Compare(times[b]); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.version, b.version)
+	})
+
+	bw := bufio.NewWriter(w)
+	for i, cmt := range commits {
+		data, err := idx.extract(cmt.path, cmt.version)
+		if err != nil {
+			return fmt.Errorf("%s @%0*d: %w", cmt.path, versionWidth, cmt.version, err)
+		}
+		rel, err := filepath.Rel(root, cmt.path)
+		if err != nil {
+			return err
+		}
+		author := cmt.author
+		if author == "" {
+			author = "sgvc"
+		}
+		mode := "100644"
+		if cmt.mode&0111 != 0 {
+			mode = "100755"
+		}
+		message := fmt.Sprintf("%s\n\nsgvc: %s @%0*d\n", cmt.message(), cmt.path, versionWidth, cmt.version)
+
+		fmt.Fprintf(bw, "commit %s\n", gitBranch)
+		fmt.Fprintf(bw, "committer %s <> %d +0000\n", strings.NewReplacer("<", "", ">", "", "\n", "").Replace(author), cmt.when.Unix())
+		fmt.Fprintf(bw, "data %d\n%s\n", len(message), message)
+		if i == 0 {
+			// the tree has only the exported files
+			fmt.Fprintf(bw, "deleteall\n")
+		}
+		fmt.Fprintf(bw, "M %s inline %s\n", mode, strings.ReplaceAll(filepath.ToSlash(rel), "\n", " "))
+		fmt.Fprintf(bw, "data %d\n", len(data))
+		bw.Write(data)
+		fmt.Fprintf(bw, "\n")
+	}
+	return bw.Flush()
+}
+
+// importGit commits the git histories of the untracked files in the
+// repository of root, like the repository of etckeeper for /etc, as their
+// versions, with the messages and the times of the git commits and the
+// git hash in the git metadata. It prints how many versions every file got.
+func (idx *index) importGit(w io.Writer, root string, paths []string) error {
+	for _, path := range paths {
+		if v := idx.currVersion(path); v != 0 {
+			return fmt.Errorf("%s has %d versions, only untracked files are imported", path, v)
+		}
+	}
+	saved := commitTime
+	defer func() { commitTime = saved }()
+	for _, path := range paths {
+		n, err := idx.importGitFile(root, path)
+		if err != nil {
+			return fmt.Errorf("imported %d versions of %s: %w", n, path, err)
+		}
+		fmt.Fprintf(w, "%s: %d versions\n", path, n)
+	}
+	return nil
+}
+
+// importGitFile commits a version of the file for every git commit that
+// changed it, oldest first, following the first parent of merges. Commits
+// that delete the file are skipped. A commit older than the version before
+// it, of a clock behind or of a rebase, is based on the latest version not
+// newer than it. It returns the number of versions committed.
+func (idx *index) importGitFile(root, path string) (int, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return 0, fmt.Errorf("not in %s", root)
+	}
+	rel = "./" + filepath.ToSlash(rel)
+	out, err := exec.Command("git", "-C", root, "log", "--first-parent", "--reverse", "--format=%x1e%H%x00%ct%x00%B", "--", rel).Output()
+	if err != nil {
+		return 0, fmt.Errorf("git log failed: %w", err)
+	}
+
+	var times []time.Time
+	var prev []byte
+	for _, rec := range strings.Split(string(out), "\x1e")[1:] {
+		parts := strings.SplitN(rec, "\x00", 3)
+		if len(parts) != 3 {
+			return len(times), fmt.Errorf("malformed git log %q", rec)
+		}
+		hash, message := parts[0], strings.TrimSpace(parts[2])
+		secs, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return len(times), fmt.Errorf("malformed git time %q", parts[1])
+		}
+		data, err := exec.Command("git", "-C", root, "cat-file", "blob", hash+":"+rel).Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// deleted by the commit
+			continue
+		}
+		if err != nil {
+			return len(times), fmt.Errorf("git cat-file failed: %w", err)
+		}
+		if times != nil && bytes.Equal(data, prev) {
+			continue
+		}
+
+		when, base := time.Unix(secs, 0).UTC(), len(times)
+		if base > 0 && when.Before(times[base-1]) {
+			for base > 0 && when.Before(times[base-1]) {
+				base--
+			}
+			if base == 0 {
+				// older than the first version, it follows the latest
+				when, base = times[len(times)-1], len(times)
+			}
+		}
+		meta := maps.Clone(commitMeta)
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta["git"] = hash
+		commitTime = when
+		if err := idx.commitContents(path, data, nil, base, message, meta, nil); err != nil {
+			return len(times), err
+		}
+		times, prev = append(times, when), data
+	}
+	if times == nil {
+		return 0, fmt.Errorf("no git history in %s", root)
+	}
+	return len(times), nil
+}
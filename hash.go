@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// content hashes of versions. Versions are verified with the strongest
+// hash they record. The manifest records the hash of new versions, chosen
+// by the hash key of the configuration when the store is created, crc32
+// in stores created before format 8, which is only read since.
+const (
+	hashCRC32  = "crc32"
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512" // faster than sha256 on 64-bit cpus without sha instructions
+)
+
+// defaultHash is the hash of new stores and of stores upgraded to format 8
+const defaultHash = hashSHA256
+
+// newStoreHash returns the hash of new stores
+func newStoreHash() (string, error) {
+	switch name := conf.get("hash"); name {
+	case "":
+		return defaultHash, nil
+	case hashSHA256, hashSHA512:
+		return name, nil
+	case hashCRC32:
+		return "", errors.New("crc32 is only read, the hash of new stores is sha256 or sha512")
+	default:
+		return "", fmt.Errorf("unknown store hash %q", name)
+	}
+}
+
+// versionHash returns the hash recorded by new versions of the store
+func (m *manifest) versionHash() string {
+	if m.hash == hashCRC32 {
+		// the store is upgraded before it is modified
+		return defaultHash
+	}
+	return m.hash
+}
+
+// newHash returns a new hash of the algorithm, nil if it is unknown
+func newHash(name string) hash.Hash {
+	switch name {
+	case hashCRC32:
+		return crc32.NewIEEE()
+	case hashSHA256:
+		return sha256.New()
+	case hashSHA512:
+		return sha512.New()
+	}
+	return nil
+}
+
+// hashSum returns the hex hash of the data with the algorithm
+func hashSum(name string, data []byte) string {
+	h := newHash(name)
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// digest returns the strongest hash recorded by the commit and its hex value
+func (cmt *commit) digest() (string, string) {
+	if cmt.sum != "" {
+		return cmt.hash, cmt.sum
+	}
+	return hashCRC32, fmt.Sprintf("%08x", cmt.dataCrc)
+}
+
+// verifier is a writer that verifies the contents of a version written to it
+type verifier struct {
+	hash.Hash
+	name, want string
+}
+
+// newVerifier returns a verifier of the contents of the commit
+func newVerifier(cmt *commit) *verifier {
+	name, want := cmt.digest()
+	return &verifier{newHash(name), name, want}
+}
+
+// verify returns an error if the contents written differ from the version
+func (v *verifier) verify() error {
+	if got := fmt.Sprintf("%x", v.Sum(nil)); got != v.want {
+		return fmt.Errorf("corrupted file, wrong %s: expected %s got %s", v.name, v.want, got)
+	}
+	return nil
+}
+
+// verifyData reports whether the data are the contents of the commit
+func verifyData(cmt *commit, data []byte) bool {
+	v := newVerifier(cmt)
+	v.Write(data)
+	return v.verify() == nil
+}
+
+// digests compares data with many versions, hashing it once per hash
+type digests struct {
+	data []byte
+	sums map[string]string
+}
+
+func newDigests(data []byte) *digests {
+	return &digests{data, make(map[string]string)}
+}
+
+// matches reports whether the data are the contents of the commit
+func (d *digests) matches(cmt *commit) bool {
+	name, want := cmt.digest()
+	sum, ok := d.sums[name]
+	if !ok {
+		sum = hashSum(name, d.data)
+		d.sums[name] = sum
+	}
+	return sum == want
+}
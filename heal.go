@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// heal restores the corrupted or missing stored contents of the commits
+// from a source with the expected crc: the working copy of the file or
+// another stored version with identical contents. It prints what was
+// healed and returns the number of versions that could not be healed.
+func (idx *index) heal(w io.Writer, commits []*commit) (int, error) {
+	if err := idx.lock(); err != nil {
+		return 0, err
+	}
+	defer idx.unlock()
+
+	lost, healed := 0, 0
+	for _, cmt := range commits {
+		if err := idx.extractTo(io.Discard, cmt.path, cmt.version); err == nil {
+			continue
+		}
+
+		source, data := idx.healSource(cmt)
+		if data == nil {
+			fmt.Fprintf(w, "%s @%0*d: lost, no source with crc %d\n", cmt.path, versionWidth, cmt.version, cmt.dataCrc)
+			lost++
+			continue
+		}
+		if err := idx.writeBlob(cmt, data); err != nil {
+			return lost, fmt.Errorf("failed to heal %s @%0*d: %w", cmt.path, versionWidth, cmt.version, err)
+		}
+		fmt.Fprintf(w, "%s @%0*d: healed from %s\n", cmt.path, versionWidth, cmt.version, source)
+		idx.logEvent("heal", cmt.path, cmt.version, "from "+source)
+		healed++
+	}
+	if healed > 0 {
+		if err := idx.replicate(nil); err != nil {
+			return lost, fmt.Errorf("failed to mirror store: %w", err)
+		}
+	}
+	return lost, nil
+}
+
+// healSource returns a description and the contents of a source with the
+// contents of the commit, or nil if there is none.
+func (idx *index) healSource(cmt *commit) (string, []byte) {
+	matches := func(data []byte) bool {
+		if !cmt.mtime.IsZero() && int64(len(data)) != cmt.size {
+			return false
+		}
+		return verifyData(cmt, data)
+	}
+
+	if data, err := os.ReadFile(cmt.path); err == nil && matches(data) {
+		return "working copy", data
+	}
+	if dir := mirrorDir(); dir != "" {
+		blob := filepath.Join(dir, blobName(cmt, idx.manifest.format, idx.manifest.layout))
+		if data, err := os.ReadFile(blob); err == nil {
+			if data, err := idx.decodeBlob(cmt, data); err == nil && matches(data) {
+				return "mirror", data
+			}
+		}
+	}
+	for _, c := range idx.commits {
+		if c == cmt || c.dataCrc != cmt.dataCrc {
+			continue
+		}
+		if data, err := idx.extract(c.path, c.version); err == nil && matches(data) {
+			return fmt.Sprintf("%s @%0*d", c.path, versionWidth, c.version), data
+		}
+	}
+	return "", nil
+}
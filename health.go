@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockWaitWindow is the period of the lock waits of -info
+const lockWaitWindow = 7 * 24 * time.Hour
+
+// health are indicators of the state of the store for monitoring
+type health struct {
+	files, versions int
+	storedBytes     int64 // of all the files with blobs, orphans too
+	orphans         int
+	lastVerify      time.Time // of any file, zero if never
+	unverifiedBytes int64     // of versions not verified since they were committed
+	lockWaits       int       // in the last lockWaitWindow
+}
+
+// orphanBlobs returns the names of the files with blobs in the store
+// that are not blobs of any version
+func (idx *index) orphanBlobs() ([]string, error) {
+	stored, err := storeBlobs(idx.workDir, idx.manifest.layout)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(map[string]bool)
+	for _, cmt := range idx.commits {
+		blobs[blobName(cmt, idx.manifest.format, idx.manifest.layout)] = true
+	}
+	var orphans []string
+	for _, name := range stored {
+		if !blobs[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans, nil
+}
+
+// loadEvents returns the events of the operation log. Malformed lines,
+// like a line being written, are skipped.
+func (idx *index) loadEvents() ([]event, error) {
+	fin, err := os.Open(idx.eventsFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	var events []event
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		var ev event
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+			events = append(events, ev)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// health computes the health indicators of the store. Verifications
+// are the verify events of -verify and -heal, of a file or all files.
+func (idx *index) health() (*health, error) {
+	h := &health{files: len(idx.paths()), versions: len(idx.commits)}
+	stored, err := storeBlobs(idx.workDir, idx.manifest.layout)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range stored {
+		if fi, err := os.Stat(filepath.Join(idx.workDir, name)); err == nil {
+			h.storedBytes += fi.Size()
+		}
+	}
+	orphans, err := idx.orphanBlobs()
+	if err != nil {
+		return nil, err
+	}
+	h.orphans = len(orphans)
+
+	events, err := idx.loadEvents()
+	if err != nil {
+		return nil, err
+	}
+	verified := make(map[string]time.Time) // "" for all files
+	for _, ev := range events {
+		switch ev.Op {
+		case "verify":
+			verified[ev.Path] = ev.Time
+			if ev.Time.After(h.lastVerify) {
+				h.lastVerify = ev.Time
+			}
+		case "lock-wait":
+			if time.Since(ev.Time) < lockWaitWindow {
+				h.lockWaits++
+			}
+		}
+	}
+	for _, cmt := range idx.commits {
+		if !verified[cmt.path].After(cmt.when) && !verified[""].After(cmt.when) {
+			h.unverifiedBytes += cmt.contentSize()
+		}
+	}
+	return h, nil
+}
+
+// print prints the indicators as tab separated names and values
+func (h *health) print(w io.Writer) {
+	lastVerify := "never"
+	if !h.lastVerify.IsZero() {
+		lastVerify = h.lastVerify.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "files\t%d\n", h.files)
+	fmt.Fprintf(w, "versions\t%d\n", h.versions)
+	fmt.Fprintf(w, "stored-bytes\t%d\n", h.storedBytes)
+	fmt.Fprintf(w, "orphan-blobs\t%d\n", h.orphans)
+	fmt.Fprintf(w, "last-verify\t%s\n", lastVerify)
+	fmt.Fprintf(w, "unverified-bytes\t%d\n", h.unverifiedBytes)
+	fmt.Fprintf(w, "lock-waits\t%d\n", h.lockWaits)
+}
+
+// healthLimit returns the integer value of the key of the configuration,
+// or def if it is not set or invalid
+func healthLimit(key string, def int64) int64 {
+	v := conf.get(key)
+	if v == "" {
+		return def
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		log.Printf("WARNING: invalid %s %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// check prints the indicators that exceed the thresholds of the
+// configuration and returns how many they are. The thresholds are
+// health-max-orphans, 0 by default, health-max-verify-age in days, 30 by
+// default, health-max-unverified in bytes with an optional K, M or G
+// suffix, and health-max-lock-waits. A negative threshold is no limit.
+func (h *health) check(w io.Writer) int {
+	exceeded := 0
+	over := func(name string, value, limit int64) {
+		if limit >= 0 && value > limit {
+			fmt.Fprintf(w, "unhealthy: %s %d exceeds %d\n", name, value, limit)
+			exceeded++
+		}
+	}
+	over("orphan-blobs", int64(h.orphans), healthLimit("health-max-orphans", 0))
+	if h.versions > 0 {
+		days := healthLimit("health-max-verify-age", 30)
+		if h.lastVerify.IsZero() {
+			if days >= 0 {
+				fmt.Fprintf(w, "unhealthy: the store was never verified\n")
+				exceeded++
+			}
+		} else {
+			over("days since last-verify", int64(time.Since(h.lastVerify)/(24*time.Hour)), days)
+		}
+	}
+	over("unverified-bytes", h.unverifiedBytes, healthLimit("health-max-unverified", -1))
+	over("lock-waits", int64(h.lockWaits), healthLimit("health-max-lock-waits", -1))
+	return exceeded
+}
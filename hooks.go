@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// webhookTimeout is how long a commit waits for a webhook
+const webhookTimeout = 10 * time.Second
+
+// hooksForPath returns the values of the settings of the key that apply
+// to the file. An empty value drops the values before it, so that
+//
+//	hook = notify-all "$1"
+//	hook .* =
+//
+// runs the hook for all files but dotfiles.
+func hooksForPath(key, path string) []string {
+	var hooks []string
+	for _, v := range conf.allForPath(key, path) {
+		if v == "" {
+			hooks = nil
+			continue
+		}
+		hooks = append(hooks, v)
+	}
+	return hooks
+}
+
+// runHooks runs the hooks and calls the webhooks of the configuration that
+// apply to the file of the commit, after it is committed with the message.
+// A hook is a sh(1) command line with the file, the version and the message
+// as $1, $2 and $3. A webhook is a url that receives a POST of the commit
+// event as json. The commit is done, failures are warnings.
+func runHooks(cmt *commit, message string) {
+	for _, command := range hooksForPath("hook", cmt.path) {
+		out, err := exec.Command("sh", "-c", command, "sh", cmt.path, strconv.Itoa(cmt.version), message).CombinedOutput()
+		if err != nil {
+			log.Printf("WARNING: hook %q failed: %v: %s", command, err, bytes.TrimSpace(out))
+		}
+	}
+	urls := hooksForPath("webhook", cmt.path)
+	if len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(newEvent("commit", cmt.path, cmt.version, message))
+	if err != nil {
+		log.Printf("WARNING: webhooks not called: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	for _, url := range urls {
+		if err := postWebhook(client, url, body); err != nil {
+			log.Printf("WARNING: webhook %s failed: %v", url, err)
+		}
+	}
+}
+
+// postWebhook posts the json body to the url
+func postWebhook(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
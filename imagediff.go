@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// imageDiff prints a summary of the changes between two images.
+// If output is not empty, it also runs compare(1) from ImageMagick
+// to write a visual diff to output.
+// It returns false, without printing anything, if either argument is not an image.
+func imageDiff(w io.Writer, from, to []byte, labelFrom, labelTo, output string) (bool, error) {
+	cfgFrom, fmtFrom, err := image.DecodeConfig(bytes.NewReader(from))
+	if err != nil {
+		return false, nil
+	}
+	cfgTo, fmtTo, err := image.DecodeConfig(bytes.NewReader(to))
+	if err != nil {
+		return false, nil
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", labelFrom, labelTo)
+	fmt.Fprintf(w, "format: %s -> %s\n", fmtFrom, fmtTo)
+	fmt.Fprintf(w, "dimensions: %dx%d -> %dx%d\n", cfgFrom.Width, cfgFrom.Height, cfgTo.Width, cfgTo.Height)
+	fmt.Fprintf(w, "size: %d -> %d bytes (%+d)\n", len(from), len(to), len(to)-len(from))
+	if output == "" {
+		return true, nil
+	}
+
+	fromFile, err := tempFile(from)
+	if err != nil {
+		return true, err
+	}
+	defer os.Remove(fromFile)
+	toFile, err := tempFile(to)
+	if err != nil {
+		return true, err
+	}
+	defer os.Remove(toFile)
+
+	// compare exits with 1 if the images differ, so only check that output exists
+	cmd := exec.Command("compare", fromFile, toFile, output)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return true, err
+		}
+	}
+	if _, err := os.Stat(output); err != nil {
+		return true, fmt.Errorf("compare failed to write %s: %w", output, err)
+	}
+	fmt.Fprintf(w, "visual diff: %s\n", output)
+	return true, nil
+}
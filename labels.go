@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// label is a named marker for a version of a file. Labels with the
+// same name mark the versions of a set of files.
+type label struct {
+	name    string
+	path    string
+	version int
+}
+
+// labelsFile returns the path of the file with the labels
+func (idx *index) labelsFile() string {
+	return filepath.Join(idx.workDir, "labels")
+}
+
+// loadLabels returns all the labels of the store
+func (idx *index) loadLabels() ([]label, error) {
+	return readLabels(idx.labelsFile())
+}
+
+// readLabels returns the labels of the file, like the one of the store
+func readLabels(file string) ([]label, error) {
+	fin, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	var labels []label
+	nlines := 0
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		nlines++
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("malformed label:%d", nlines)
+		}
+		version, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("malformed label version:%d", nlines)
+		}
+		labels = append(labels, label{parts[0], parts[1], version})
+	}
+	return labels, scanner.Err()
+}
+
+// labelled returns the labels with the name
+func (idx *index) labelled(name string) ([]label, error) {
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return nil, err
+	}
+	var named []label
+	for _, l := range labels {
+		if l.name == name {
+			named = append(named, l)
+		}
+	}
+	if len(named) == 0 {
+		return nil, fmt.Errorf("no label %s", name)
+	}
+	return named, nil
+}
+
+// addLabel marks the latest versions of the files with the name
+func (idx *index) addLabel(name string, paths []string) error {
+	if name == "" || strings.ContainsAny(name, "\t\n") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	defer idx.unlock()
+
+	if _, err := idx.labelled(name); err == nil {
+		return fmt.Errorf("label %s exists", name)
+	}
+	var lines []string
+	for _, path := range paths {
+		version := idx.currVersion(path)
+		if version == 0 {
+			return fmt.Errorf("no versions for %s", path)
+		}
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%0*d", name, path, versionWidth, version))
+	}
+	if err := appendLines(idx.labelsFile(), lines); err != nil {
+		return err
+	}
+	idx.logEvent("label", "", 0, name)
+	if err := idx.replicate(nil); err != nil {
+		return fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return nil
+}
+
+// moveLabels makes the labels of oldPath labels of newPath. It must be
+// called with the store locked.
+func (idx *index) moveLabels(oldPath, newPath string) error {
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(labels, func(l label) bool { return l.path == oldPath }) {
+		return nil
+	}
+	for i := range labels {
+		if labels[i].path == oldPath {
+			labels[i].path = newPath
+		}
+	}
+	return writeLabels(idx.labelsFile(), labels)
+}
+
+// writeLabels replaces the file with the labels
+func writeLabels(file string, labels []label) error {
+	tmp, err := createTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s\t%s\t%0*d\n", l.name, l.path, versionWidth, l.version)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
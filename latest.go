@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// latestDir returns the directory with a symlink to the latest version
+// of every tracked file. It is maintained only if it exists.
+func (idx *index) latestDir() string {
+	return filepath.Join(idx.workDir, "latest")
+}
+
+// latestEnabled reports whether the latest view is maintained
+func (idx *index) latestEnabled() bool {
+	fi, err := os.Stat(idx.latestDir())
+	return err == nil && fi.IsDir()
+}
+
+// linkLatest points the link of the commit path in the latest view to the
+// contents of the commit. If symlinks are not supported the contents are copied.
+func (idx *index) linkLatest(cmt *commit) error {
+	link := filepath.Join(idx.latestDir(), url.QueryEscape(cmt.path))
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	target := filepath.Join("..", blobName(cmt, idx.manifest.format, idx.manifest.layout))
+	// encoded blobs are copied since the link must show the contents
+	if cmt.encoding != "" || os.Symlink(target, tmp) != nil {
+		// the commit may not be loaded yet, read its blob
+		fin, err := idx.openBlob(cmt)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(fin)
+		fin.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(tmp, data, fileMode); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, link)
+}
+
+// refreshLatest creates the latest view and links every tracked file
+// to its latest version. Links of files that are no longer tracked are removed.
+func (idx *index) refreshLatest() error {
+	if err := mkdirAll(idx.latestDir()); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(idx.latestDir())
+	if err != nil {
+		return err
+	}
+	tracked := make(map[string]bool)
+	for _, path := range idx.paths() {
+		tracked[url.QueryEscape(path)] = true
+	}
+	for _, e := range entries {
+		if !tracked[e.Name()] {
+			if err := os.Remove(filepath.Join(idx.latestDir(), e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	// commits are sorted by path and descending version
+	for i, cmt := range idx.commits {
+		if i > 0 && idx.commits[i-1].path == cmt.path {
+			continue
+		}
+		if err := idx.linkLatest(cmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// store layouts, the names of the blobs in the store. The layout is
+// chosen by the layout key of the configuration when the store is
+// created and recorded in its manifest.
+const (
+	// <path signature>-<version><ext> in the store directory
+	layoutPath = "path"
+	// blobs/<ab>/<sha256 ab...> shared by versions with identical contents
+	layoutHash = "hash"
+	// <yyyy>/<mm>/<path signature>-<version><ext> of the commit time in UTC
+	layoutDate = "date"
+)
+
+// newStoreLayout returns the layout of new stores
+func newStoreLayout() (string, error) {
+	switch layout := conf.get("layout"); layout {
+	case "":
+		return layoutPath, nil
+	case layoutPath, layoutHash, layoutDate:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown store layout %q", layout)
+	}
+}
+
+// layoutName returns the name of the blob in the layout, relative to the
+// store, given its name in the path layout
+func layoutName(cmt *commit, layout, name string) string {
+	switch layout {
+	case layoutHash:
+		if len(cmt.sum) < 2 {
+			// cannot happen unless the index is edited
+			return name
+		}
+		name = cmt.sum
+		if cmt.encoding != "" {
+			name += ".gz"
+		}
+		return filepath.Join("blobs", cmt.sum[:2], name)
+	case layoutDate:
+		when := cmt.when.UTC()
+		return filepath.Join(when.Format("2006"), when.Format("01"), name)
+	}
+	return name
+}
+
+// blobDirs returns the directories of the store with blobs of the layout
+// in subdirectories
+func blobDirs(workDir, layout string) []string {
+	switch layout {
+	case layoutHash:
+		return []string{filepath.Join(workDir, "blobs")}
+	case layoutDate:
+		entries, _ := os.ReadDir(workDir)
+		var dirs []string
+		for _, e := range entries {
+			if e.IsDir() && len(e.Name()) == 4 && strings.Trim(e.Name(), "0123456789") == "" {
+				dirs = append(dirs, filepath.Join(workDir, e.Name()))
+			}
+		}
+		return dirs
+	}
+	return nil
+}
+
+// storeBlobs returns the names of the blob files in the store, relative to it
+func storeBlobs(workDir, layout string) ([]string, error) {
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && isBlobName(e.Name()) {
+			blobs = append(blobs, e.Name())
+		}
+	}
+	for _, dir := range blobDirs(workDir, layout) {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() && !strings.HasSuffix(path, ".tmp") {
+				rel, err := filepath.Rel(workDir, path)
+				if err != nil {
+					return err
+				}
+				blobs = append(blobs, rel)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return blobs, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockTimeout is how long to wait for another sgvc to release the store lock
+const lockTimeout = 10 * time.Second
+
+// lockFile returns the path of the store lock
+func (idx *index) lockFile() string {
+	return filepath.Join(idx.workDir, "lock")
+}
+
+// lock acquires the store lock. The lock is a file created exclusively
+// which records the pid of the holder, the acquisition time, the user
+// and the host.
+// Every modification of the store needs the lock, so lock also refuses
+// to modify stores with a newer format and upgrades older ones.
+func (idx *index) lock() error {
+	if err := idx.manifest.writable(); err != nil {
+		return err
+	}
+	if err := checkAccess(idx.workDir, "w"); err != nil {
+		return err
+	}
+	start, contended := time.Now(), false
+	deadline := start.Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(idx.lockFile(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+		if err == nil {
+			host, _ := os.Hostname()
+			_, err = fmt.Fprintf(f, "%d %s %s %s\n", os.Getpid(), time.Now().Format(time.RFC3339),
+				url.QueryEscape(currentUser()), url.QueryEscape(host))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(idx.lockFile())
+				return fmt.Errorf("failed to write lock: %w", err)
+			}
+			if err := idx.upgradeStore(); err != nil {
+				os.Remove(idx.lockFile())
+				return fmt.Errorf("failed to upgrade store: %w", err)
+			}
+			if contended {
+				idx.logEvent("lock-wait", "", 0, "waited "+time.Since(start).Round(time.Millisecond).String())
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to lock store: %w", err)
+		}
+		contended = true
+		if time.Now().After(deadline) {
+			idx.logEvent("lock-wait", "", 0, "timed out")
+			if h, err := idx.lockHolder(); err == nil && h != nil {
+				return fmt.Errorf("store is locked by %s. If it crashed run sgvc -break-lock", h)
+			}
+			return errors.New("store is locked")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// unlock releases the store lock
+func (idx *index) unlock() {
+	os.Remove(idx.lockFile())
+}
+
+// holder describes the process holding the store lock
+type holder struct {
+	pid   int
+	since time.Time
+	user  string // empty for locks of older versions of sgvc
+	host  string
+}
+
+func (h *holder) String() string {
+	s := fmt.Sprintf("pid %d", h.pid)
+	if h.user != "" {
+		s += fmt.Sprintf(" of %s on %s", h.user, h.host)
+	}
+	return s + " since " + h.since.Format(time.RFC3339)
+}
+
+// running reports whether the process of the holder is running, if
+// it is known. It is known only on the host of the holder.
+func (h *holder) running() (bool, bool) {
+	if host, _ := os.Hostname(); h.host != host {
+		return false, false
+	}
+	return processRunning(h.pid)
+}
+
+// lockHolder returns the holder of the store lock, or nil if the store
+// is not locked
+func (idx *index) lockHolder() (*holder, error) {
+	data, err := os.ReadFile(idx.lockFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 && len(fields) != 4 {
+		return nil, fmt.Errorf("malformed lock %q", data)
+	}
+	h := &holder{}
+	if h.pid, err = strconv.Atoi(fields[0]); err != nil {
+		return nil, fmt.Errorf("malformed lock %q", data)
+	}
+	if h.since, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+		return nil, fmt.Errorf("malformed lock %q", data)
+	}
+	if len(fields) == 4 {
+		h.user, _ = url.QueryUnescape(fields[2])
+		h.host, _ = url.QueryUnescape(fields[3])
+	}
+	return h, nil
+}
+
+// lockStatus prints the holder of the store lock
+func (idx *index) lockStatus(w io.Writer) error {
+	h, err := idx.lockHolder()
+	if err != nil || h == nil {
+		if err == nil {
+			fmt.Fprintln(w, "unlocked")
+		}
+		return err
+	}
+	fmt.Fprintf(w, "locked by %s", h)
+	if running, known := h.running(); known && running {
+		fmt.Fprint(w, ", running")
+	} else if known {
+		fmt.Fprint(w, ", not running")
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// breakLock removes the lock of a crashed sgvc after asking for confirmation
+func (idx *index) breakLock() error {
+	h, err := idx.lockHolder()
+	if err != nil {
+		// a damaged lock is broken too
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	} else if h == nil {
+		fmt.Fprintln(os.Stderr, "store is not locked")
+		return nil
+	} else {
+		fmt.Fprintf(os.Stderr, "store is locked by %s\n", h)
+		if running, known := h.running(); known && running {
+			fmt.Fprintln(os.Stderr, "WARNING: the process is still running")
+		}
+	}
+	fmt.Fprint(os.Stderr, "break the lock? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return errors.New("lock not broken")
+	}
+	if err := os.Remove(idx.lockFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	detail := "damaged lock"
+	if h != nil {
+		detail = h.String()
+	}
+	idx.logEvent("break-lock", "", 0, detail)
+	return nil
+}
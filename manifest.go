@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// storeFormat is the format of the stores written by this version of sgvc.
+// It must be incremented on every incompatible change of the index or the
+// blobs. Stores with a newer format are opened read only.
+//
+//	1: the original format
+//	2: index lines end with a crc
+//	3: index lines have optional key=value fields
+//	4: blob names do not zero pad versions
+//	5: blob names keep the extension of the file
+//	6: blobs may be compressed
+//	7: the manifest records the layout of the blobs
+//	8: versions record the hash of the manifest, sha256 or sha512
+//	9: blobs may be deltas of other versions
+const storeFormat = 9
+
+// manifest describes the store. It is a file of key=value lines in workDir.
+type manifest struct {
+	format int    // store format
+	writer string // version of sgvc that wrote the store format
+	layout string // layout of the blobs, path in stores created before format 7
+	hash   string // content hash of new versions, crc32 in stores before format 8
+}
+
+// toolVersion returns the version of this binary
+func toolVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		return "sgvc " + bi.Main.Version
+	}
+	return "sgvc (unknown)"
+}
+
+// manifestFile returns the path of the store manifest
+func manifestFile(workDir string) string {
+	return filepath.Join(workDir, "manifest")
+}
+
+// readManifest reads the store manifest. Stores created before manifests
+// existed are format 1 and get a manifest.
+func readManifest(workDir string) (*manifest, error) {
+	fin, err := os.Open(manifestFile(workDir))
+	if errors.Is(err, os.ErrNotExist) {
+		m := &manifest{format: 1, writer: toolVersion(), layout: layoutPath, hash: hashCRC32}
+		return m, m.write(workDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	m := &manifest{layout: layoutPath, hash: hashCRC32}
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed manifest line %q", scanner.Text())
+		}
+		switch key {
+		case "format":
+			if m.format, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("malformed manifest format %q", value)
+			}
+		case "writer":
+			m.writer = value
+		case "layout":
+			m.layout = value
+		case "hash":
+			m.hash = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.format == 0 {
+		return nil, errors.New("manifest has no format")
+	}
+	if m.layout != layoutPath && m.layout != layoutHash && m.layout != layoutDate {
+		return nil, fmt.Errorf("unknown store layout %q", m.layout)
+	}
+	return m, nil
+}
+
+// write writes the manifest to the store
+func (m *manifest) write(workDir string) error {
+	s := fmt.Sprintf("format=%d\nwriter=%s\nlayout=%s\nhash=%s\n", m.format, m.writer, m.layout, m.hash)
+	tmp := manifestFile(workDir) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(s), fileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, manifestFile(workDir))
+}
+
+// writable returns an error if the store was written by a newer, incompatible sgvc
+func (m *manifest) writable() error {
+	if m.format > storeFormat {
+		return fmt.Errorf("store has format %d, written by %s, but this sgvc supports format %d. Upgrade sgvc to modify it",
+			m.format, m.writer, storeFormat)
+	}
+	if newHash(m.hash) == nil {
+		return fmt.Errorf("store hashes versions with %s, written by %s, which this sgvc does not support. Upgrade sgvc to modify it",
+			m.hash, m.writer)
+	}
+	return nil
+}
+
+// upgrade records that the store is now written in the current format
+func (m *manifest) upgrade(workDir string) error {
+	if m.format >= storeFormat {
+		return nil
+	}
+	m.format, m.writer, m.hash = storeFormat, toolVersion(), defaultHash
+	return m.write(workDir)
+}
+
+// upgradeStore migrates the store to the current format. It must be
+// called with the store locked. An interrupted migration is resumed
+// the next time since the manifest is upgraded last.
+func (idx *index) upgradeStore() error {
+	if idx.manifest.format >= storeFormat {
+		return nil
+	}
+	if err := idx.loadCommits(); err != nil {
+		return err
+	}
+	for _, cmt := range idx.commits {
+		oldPath := filepath.Join(idx.workDir, blobName(cmt, idx.manifest.format, idx.manifest.layout))
+		newPath := filepath.Join(idx.workDir, blobName(cmt, storeFormat, idx.manifest.layout))
+		if _, err := os.Stat(newPath); err == nil || oldPath == newPath {
+			continue
+		}
+		if err := os.Rename(oldPath, newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := idx.manifest.upgrade(idx.workDir); err != nil {
+		return err
+	}
+	// the modes of renamed blobs are checked once, not on every run
+	hardenStore(idx.workDir, idx.manifest.layout, true)
+	// blob names may have changed
+	if idx.latestEnabled() {
+		return idx.refreshLatest()
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// mirrorDir returns the directory, set by the mirror key of the
+// configuration, to which the store is replicated. It is empty
+// if the store is not replicated.
+func mirrorDir() string {
+	return conf.get("mirror")
+}
+
+// replicate copies the changes of the store to the mirror. The commit,
+// if not nil, is the only change and then only its blob and index line
+// are copied. If the configuration sets mirror-async, a background sgvc
+// -mirror does the copying and replicate returns immediately.
+// It must be called with the store locked.
+func (idx *index) replicate(cmt *commit) error {
+	dir := mirrorDir()
+	if dir == "" {
+		return nil
+	}
+	if conf.getBool("mirror-async") {
+		// the child waits for the lock and copies everything
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		child := exec.Command(exe, "-mirror")
+		if err := child.Start(); err != nil {
+			return err
+		}
+		return child.Process.Release()
+	}
+	if cmt != nil {
+		return idx.mirrorCommit(dir, cmt)
+	}
+	return idx.mirror(dir)
+}
+
+// mirrorCommit copies the blob and the index line of the commit, which
+// must be the last line of the index, to the mirror. If the mirror is
+// behind, because of an earlier failure, everything is copied.
+func (idx *index) mirrorCommit(dir string, cmt *commit) error {
+	local, err := os.Stat(idx.commitsFile)
+	if err != nil {
+		return err
+	}
+	line := cmt.serialize()
+	remote, err := os.Stat(filepath.Join(dir, "index"))
+	if err != nil || remote.Size()+int64(len(line))+1 != local.Size() {
+		return idx.mirror(dir)
+	}
+	name := blobName(cmt, idx.manifest.format, idx.manifest.layout)
+	if err := copyFile(idx.filePath(cmt), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return appendLines(filepath.Join(dir, "index"), []string{line})
+}
+
+// mirror copies the blobs missing from the mirror and the index, the
+// manifest and the labels. The mirror is a store itself and can be used
+// by setting the store key of the configuration to it.
+func (idx *index) mirror(dir string) error {
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+	for _, cmt := range idx.commits {
+		dst := filepath.Join(dir, blobName(cmt, idx.manifest.format, idx.manifest.layout))
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := copyFile(idx.filePath(cmt), dst); err != nil {
+			return fmt.Errorf("version %d of %s: %w", cmt.version, cmt.path, err)
+		}
+	}
+	// the index is copied last, so that it never refers to missing blobs
+	for _, name := range []string{"manifest", "labels", "refs", "events", "index.quarantine", "index"} {
+		err := copyFile(filepath.Join(idx.workDir, name), filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst with the same mode. The copy is synced and
+// renamed over dst, so dst is either the old or the new file.
+func copyFile(src, dst string) error {
+	fin, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fi, err := fin.Stat()
+	if err != nil {
+		return err
+	}
+
+	// blobs of some layouts are in subdirectories
+	if err := mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	fout, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fout, fin)
+	if err == nil {
+		err = fout.Sync()
+	}
+	if err == nil {
+		err = fout.Chmod(fi.Mode().Perm())
+	}
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
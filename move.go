@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// rename is a tracked file that disappeared and an untracked file
+// with the contents of its latest version
+type rename struct {
+	from, to string
+}
+
+// renames finds tracked files that are missing and untracked files with the
+// contents of their latest version, in the directories of the tracked files.
+func (idx *index) renames() ([]rename, error) {
+	tracked := make(map[string]bool)
+	dirs := make(map[string]bool)
+	var missing []*commit
+	// commits are sorted by path and descending version
+	for i, cmt := range idx.commits {
+		if i > 0 && idx.commits[i-1].path == cmt.path {
+			continue
+		}
+		tracked[cmt.path] = true
+		dirs[filepath.Dir(cmt.path)] = true
+		if _, err := os.Stat(cmt.path); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, cmt)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	var found []rename
+	for dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if !e.Type().IsRegular() || tracked[path] {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil {
+				continue
+			}
+			var d *digests
+			for _, cmt := range missing {
+				if !cmt.mtime.IsZero() && fi.Size() != cmt.size {
+					continue
+				}
+				if d == nil {
+					data, err := os.ReadFile(path)
+					if err != nil {
+						break
+					}
+					d = newDigests(data)
+				}
+				if d.matches(cmt) {
+					found = append(found, rename{cmt.path, path})
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// move moves the history, the labels and the refs of the file from oldPath to
+// newPath, which must not be tracked.
+func (idx *index) move(oldPath, newPath string) error {
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	defer idx.unlock()
+
+	if err := idx.loadCommits(); err != nil {
+		return err
+	}
+	if idx.currVersion(oldPath) == 0 {
+		return fmt.Errorf("%s is not tracked", oldPath)
+	}
+	if idx.currVersion(newPath) != 0 {
+		return fmt.Errorf("%s is already tracked", newPath)
+	}
+
+	// the blobs are linked to their new names before the index is
+	// rewritten and the old names are removed after
+	var commits []*commit
+	var oldBlobs []string
+	for _, cmt := range idx.commits {
+		if cmt.path != oldPath {
+			commits = append(commits, cmt)
+			continue
+		}
+		moved := *cmt
+		moved.path, moved.pathSig = newPath, pathSignature(newPath)
+		commits = append(commits, &moved)
+		if idx.filePath(cmt) == idx.filePath(&moved) {
+			// the hash layout does not depend on the path
+			continue
+		}
+		if err := mkdirAll(filepath.Dir(idx.filePath(&moved))); err != nil {
+			return err
+		}
+		if err := linkOrCopy(idx.filePath(cmt), idx.filePath(&moved)); err != nil {
+			return fmt.Errorf("failed to move version %d: %w", cmt.version, err)
+		}
+		oldBlobs = append(oldBlobs, idx.filePath(cmt))
+	}
+	if err := idx.writeIndex(commits); err != nil {
+		return err
+	}
+	for _, blob := range oldBlobs {
+		os.Remove(blob)
+	}
+	if err := idx.moveLabels(oldPath, newPath); err != nil {
+		return fmt.Errorf("moved the history but not the labels: %w", err)
+	}
+	if err := idx.moveRefs(oldPath, newPath); err != nil {
+		return fmt.Errorf("moved the history but not the refs: %w", err)
+	}
+	idx.logEvent("move", newPath, 0, "from "+oldPath)
+
+	if idx.latestEnabled() {
+		os.Remove(filepath.Join(idx.latestDir(), url.QueryEscape(oldPath)))
+		if cmt, err := idx.lookup(newPath, idx.currVersion(newPath)); err == nil {
+			if err := idx.linkLatest(cmt); err != nil {
+				return err
+			}
+		}
+	}
+	if err := idx.replicate(nil); err != nil {
+		return fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return nil
+}
+
+// linkOrCopy makes newPath a hard link of oldPath, or a copy if
+// hard links are not supported
+func linkOrCopy(oldPath, newPath string) error {
+	if err := os.Link(oldPath, newPath); err == nil {
+		return nil
+	}
+	fin, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fout, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fout, fin); err != nil {
+		fout.Close()
+		os.Remove(newPath)
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(newPath, blobMode)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// processRunning is not supported on this platform
+func processRunning(pid int) (bool, bool) {
+	return false, false
+}
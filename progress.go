@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// progressOut receives the progress of long operations as json lines,
+// nil if it is not reported
+var progressOut io.Writer
+
+// setProgressFd reports the progress to the open file descriptor
+func setProgressFd(fd int) error {
+	f := os.NewFile(uintptr(fd), "progress")
+	if f == nil {
+		return os.ErrInvalid
+	}
+	if _, err := f.Stat(); err != nil {
+		return err
+	}
+	progressOut = f
+	return nil
+}
+
+// readFile reads the file reporting the progress
+func readFile(path string, p *progress) ([]byte, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	return io.ReadAll(io.TeeReader(fin, p))
+}
+
+// progressEvent is a line of the progress output. Percent is -1 if the
+// total is unknown.
+type progressEvent struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Bytes   int64  `json:"bytes"`
+	Total   int64  `json:"total"`
+	Percent int    `json:"percent"`
+	Done    bool   `json:"done,omitempty"`
+}
+
+// progress is a writer that reports the bytes written to it as
+// progress of the operation on the file, every percent or, if the
+// total is unknown, every MiB
+type progress struct {
+	ev   progressEvent
+	last int64
+}
+
+// newProgress returns the progress of the operation on the file of total
+// bytes, 0 if unknown, or nil if progress is not reported. Writes to a nil
+// progress are discarded.
+func newProgress(op, path string, total int64) *progress {
+	if progressOut == nil {
+		return nil
+	}
+	p := &progress{ev: progressEvent{Op: op, Path: path, Total: total}, last: -1}
+	p.report()
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	if p == nil {
+		return len(b), nil
+	}
+	p.ev.Bytes += int64(len(b))
+	p.report()
+	return len(b), nil
+}
+
+// done reports the end of the operation
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.ev.Done, p.ev.Total = true, p.ev.Bytes
+	p.report()
+}
+
+func (p *progress) report() {
+	step := p.ev.Bytes >> 20
+	p.ev.Percent = -1
+	if p.ev.Total > 0 {
+		p.ev.Percent = int(min(p.ev.Bytes*100/p.ev.Total, 100))
+		step = int64(p.ev.Percent)
+	} else if p.ev.Done {
+		p.ev.Percent = 100
+	}
+	if step == p.last && !p.ev.Done {
+		return
+	}
+	p.last = step
+	if b, err := json.Marshal(&p.ev); err == nil {
+		progressOut.Write(append(b, '\n'))
+	}
+}
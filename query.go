@@ -0,0 +1,222 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// query is a compiled filter expression of commits, like
+//
+//	path ~ "/etc/" and when > 2024-01-01 and message ~ "tls"
+//
+// A comparison is a field, an operator and a value. The fields are path,
+// message, author, version, base, when, size and meta.<key>, the operators
+// are = != < <= > >= and ~, which matches a regular expression. Versions,
+// bases and sizes compare as numbers, when as dates of -timeline, the
+// others as strings. Comparisons combine with and, or, not and parentheses.
+// Values with spaces or operators are quoted like Go strings.
+type query func(cmt *commit) bool
+
+// parseQuery compiles the filter expression
+func parseQuery(s string) (query, error) {
+	p := &queryParser{s: s}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	if tok := p.next(); tok != "" {
+		return nil, fmt.Errorf("invalid query: unexpected %s", tok)
+	}
+	return q, nil
+}
+
+// queryParser is a recursive descent parser of queries
+type queryParser struct {
+	s    string
+	peek string // the lookahead token, if any
+}
+
+// next returns the next token, or "" at the end of the expression
+func (p *queryParser) next() string {
+	if p.peek != "" {
+		tok := p.peek
+		p.peek = ""
+		return tok
+	}
+	p.s = strings.TrimLeftFunc(p.s, unicode.IsSpace)
+	if p.s == "" {
+		return ""
+	}
+	n := 1
+	switch {
+	case strings.HasPrefix(p.s, "!="), strings.HasPrefix(p.s, "<="), strings.HasPrefix(p.s, ">="):
+		n = 2
+	case strings.ContainsRune("()=<>~", rune(p.s[0])):
+	case p.s[0] == '"' || p.s[0] == '`':
+		if q, err := strconv.QuotedPrefix(p.s); err == nil {
+			n = len(q)
+		}
+	default:
+		n = strings.IndexFunc(p.s, func(r rune) bool {
+			return unicode.IsSpace(r) || strings.ContainsRune("()=!<>~\"", r)
+		})
+		if n < 0 {
+			n = len(p.s)
+		} else if n == 0 {
+			n = 1
+		}
+	}
+	tok := p.s[:n]
+	p.s = p.s[n:]
+	return tok
+}
+
+// lookahead returns the next token without consuming it
+func (p *queryParser) lookahead() string {
+	if p.peek == "" {
+		p.peek = p.next()
+	}
+	return p.peek
+}
+
+func (p *queryParser) parseOr() (query, error) {
+	q, err := p.parseAnd()
+	for err == nil && p.lookahead() == "or" {
+		p.next()
+		var r query
+		if r, err = p.parseAnd(); err == nil {
+			l := q
+			q = func(cmt *commit) bool { return l(cmt) || r(cmt) }
+		}
+	}
+	return q, err
+}
+
+func (p *queryParser) parseAnd() (query, error) {
+	q, err := p.parseNot()
+	for err == nil && p.lookahead() == "and" {
+		p.next()
+		var r query
+		if r, err = p.parseNot(); err == nil {
+			l := q
+			q = func(cmt *commit) bool { return l(cmt) && r(cmt) }
+		}
+	}
+	return q, err
+}
+
+func (p *queryParser) parseNot() (query, error) {
+	switch p.lookahead() {
+	case "not":
+		p.next()
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(cmt *commit) bool { return !q(cmt) }, nil
+	case "(":
+		p.next()
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok == "" {
+			return nil, fmt.Errorf("missing )")
+		} else if tok != ")" {
+			return nil, fmt.Errorf("missing ) before %s", tok)
+		}
+		return q, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (query, error) {
+	field, op, value := p.next(), p.next(), p.next()
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=", "~":
+	default:
+		return nil, fmt.Errorf("missing operator after %q", field)
+	}
+	if value == "" || value == "(" || value == ")" {
+		return nil, fmt.Errorf("missing value after %s %s", field, op)
+	}
+	if value[0] == '"' || value[0] == '`' {
+		v, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed string after %s %s", field, op)
+		}
+		value = v
+	}
+
+	var get func(cmt *commit) string
+	var compare func(cmt *commit) int
+	switch field {
+	case "path":
+		get = func(cmt *commit) string { return cmt.path }
+	case "message":
+		get = func(cmt *commit) string { return cmt.message() }
+	case "author":
+		get = func(cmt *commit) string { return cmt.author }
+	case "version", "base", "size":
+		number := map[string]func(cmt *commit) int64{
+			"version": func(cmt *commit) int64 { return int64(cmt.version) },
+			"base":    func(cmt *commit) int64 { return int64(cmt.basedOn) },
+			"size":    func(cmt *commit) int64 { return cmt.contentSize() },
+		}[field]
+		get = func(cmt *commit) string { return strconv.FormatInt(number(cmt), 10) }
+		if op != "~" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s %s: not a number", field, op, value)
+			}
+			compare = func(cmt *commit) int { return cmp.Compare(number(cmt), n) }
+		}
+	case "when":
+		get = func(cmt *commit) string { return cmt.when.Format(time.RFC3339) }
+		if op != "~" {
+			t, err := parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+			compare = func(cmt *commit) int { return cmt.when.Compare(t) }
+		}
+	default:
+		key, ok := strings.CutPrefix(field, "meta.")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		get = func(cmt *commit) string { return cmt.meta[key] }
+	}
+
+	if op == "~" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(cmt *commit) bool { return re.MatchString(get(cmt)) }, nil
+	}
+	if compare == nil {
+		compare = func(cmt *commit) int { return strings.Compare(get(cmt), value) }
+	}
+	return func(cmt *commit) bool {
+		c := compare(cmt)
+		switch op {
+		case "=":
+			return c == 0
+		case "!=":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
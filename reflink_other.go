@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// reflink is not supported on this platform
+func reflink(src, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
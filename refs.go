@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ref is an identifier of an external system pinned to a version of a
+// file, like the ticket of a change or the id of a puppet run. A version
+// may have many refs and a ref many versions.
+type ref struct {
+	id      string
+	path    string
+	version int
+}
+
+// refsFile returns the path of the file with the refs
+func (idx *index) refsFile() string {
+	return filepath.Join(idx.workDir, "refs")
+}
+
+// loadRefs returns all the refs of the store
+func (idx *index) loadRefs() ([]ref, error) {
+	return readRefs(idx.refsFile())
+}
+
+// readRefs returns the refs of the file, like the one of the store
+func readRefs(file string) ([]ref, error) {
+	fin, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	var refs []ref
+	nlines := 0
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		nlines++
+		parts := strings.Split(scanner.Text(), "\t")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("malformed ref:%d", nlines)
+		}
+		version, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("malformed ref version:%d", nlines)
+		}
+		refs = append(refs, ref{parts[0], parts[1], version})
+	}
+	return refs, scanner.Err()
+}
+
+// pinRef pins the external identifier to the version of the file
+func (idx *index) pinRef(path string, version int, id string) error {
+	if id == "" || strings.ContainsAny(id, "\t\n") {
+		return fmt.Errorf("invalid ref %q", id)
+	}
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	defer idx.unlock()
+
+	if _, err := idx.lookup(path, version); err != nil {
+		return err
+	}
+	refs, err := idx.loadRefs()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(refs, ref{id, path, version}) {
+		return fmt.Errorf("%s is pinned to version %d of %s already", id, version, path)
+	}
+	line := fmt.Sprintf("%s\t%s\t%0*d", id, path, versionWidth, version)
+	if err := appendLines(idx.refsFile(), []string{line}); err != nil {
+		return err
+	}
+	idx.logEvent("pin-ref", path, version, id)
+	if err := idx.replicate(nil); err != nil {
+		return fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return nil
+}
+
+// pinned returns the versions pinned to the external identifier
+func (idx *index) pinned(id string) ([]*commit, error) {
+	refs, err := idx.loadRefs()
+	if err != nil {
+		return nil, err
+	}
+	var commits []*commit
+	for _, r := range refs {
+		if r.id != id {
+			continue
+		}
+		// versions may have been pruned or forgotten since
+		if cmt, err := idx.lookup(r.path, r.version); err == nil {
+			commits = append(commits, cmt)
+		}
+	}
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("no versions pinned to %s", id)
+	}
+	return commits, nil
+}
+
+// moveRefs makes the refs of oldPath refs of newPath. It must be called
+// with the store locked.
+func (idx *index) moveRefs(oldPath, newPath string) error {
+	refs, err := idx.loadRefs()
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(refs, func(r ref) bool { return r.path == oldPath }) {
+		return nil
+	}
+	for i := range refs {
+		if refs[i].path == oldPath {
+			refs[i].path = newPath
+		}
+	}
+	return writeRefs(idx.refsFile(), refs)
+}
+
+// writeRefs replaces the file with the refs
+func writeRefs(file string, refs []ref) error {
+	tmp, err := createTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, r := range refs {
+		fmt.Fprintf(w, "%s\t%s\t%0*d\n", r.id, r.path, versionWidth, r.version)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
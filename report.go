@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+pre { background: #f6f8fa; padding: 1em; overflow-x: auto; }
+.add { color: #22863a; }
+.del { color: #b31d28; }
+.hunk { color: #6f42c1; }
+.file { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.Path}}</h1>
+<p>Generated {{.Generated}}</p>
+<table>
+<tr><th>Version</th><th>Date</th><th>Base</th><th>Changes</th></tr>
+{{range .Versions}}<tr><td><a href="#v{{.Version}}">{{.Version}}</a></td><td>{{.When}}</td><td>{{.BasedOn}}</td><td>{{.Changes}}</td></tr>
+{{end}}</table>
+{{range .Versions}}<h2 id="v{{.Version}}">{{.Version}} {{.Changes}}</h2>
+<pre>{{range .Diff}}<span class="{{.Class}}">{{.Text}}</span>
+{{end}}</pre>
+{{end}}</body>
+</html>
+`))
+
+type reportLine struct {
+	Class string
+	Text  string
+}
+
+type reportVersion struct {
+	Version string
+	When    string
+	BasedOn string
+	Changes string
+	Diff    []reportLine
+}
+
+// report writes a self contained html page with the history of the file
+// and the diffs between consecutive versions. It returns the name of the page.
+func (idx *index) report(path, dir string) (string, error) {
+	commits := idx.filter(path)
+	if len(commits) == 0 {
+		return "", fmt.Errorf("no versions for %s", path)
+	}
+
+	data := struct {
+		Path      string
+		Generated string
+		Versions  []reportVersion
+	}{Path: path, Generated: time.Now().Format(time.RFC3339)}
+
+	var prev []byte
+	prevLabel := "/dev/null"
+	for i := len(commits) - 1; i >= 0; i-- {
+		cmt := commits[i]
+		curr, err := idx.extract(cmt.path, cmt.version)
+		if err != nil {
+			return "", err
+		}
+		if curr, err = textconv(cmt.path, curr); err != nil {
+			return "", err
+		}
+		label := fmt.Sprintf("%s @%0*d", cmt.path, versionWidth, cmt.version)
+		var out bytes.Buffer
+		if err := diff(&out, prev, curr, prevLabel, label); err != nil {
+			return "", err
+		}
+
+		rv := reportVersion{
+			Version: fmt.Sprintf("%0*d", versionWidth, cmt.version),
+			When:    cmt.when.Format(time.RFC3339),
+			BasedOn: fmt.Sprintf("%0*d", versionWidth, cmt.basedOn),
+			Changes: cmt.changes,
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+			class := ""
+			switch {
+			case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+				class = "file"
+			case strings.HasPrefix(line, "@@"):
+				class = "hunk"
+			case strings.HasPrefix(line, "+"):
+				class = "add"
+			case strings.HasPrefix(line, "-"):
+				class = "del"
+			}
+			rv.Diff = append(rv.Diff, reportLine{class, line})
+		}
+		data.Versions = append(data.Versions, rv)
+		prev, prevLabel = curr, label
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fname := filepath.Join(dir, filepath.Base(path)+".html")
+	var b bytes.Buffer
+	if err := reportTemplate.Execute(&b, data); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return fname, nil
+}
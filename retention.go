@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// maxVersions returns the number of versions of the file to keep, set
+// by the max-versions key of the configuration, or 0 to keep all
+func maxVersions(path string) int {
+	v, ok := conf.forPath("max-versions", path)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("WARNING: invalid max-versions %q for %s", v, path)
+		return 0
+	}
+	return n
+}
+
+// prune moves the oldest versions of the file beyond its maximum number
+// of versions to the trash. Labelled versions are pinned and neither pruned
+// nor counted. Versions based on pruned ones are rebased on their nearest
+// kept ancestor, the trash keeps the original bases. It must be called with
+// the store locked and returns the number of pruned versions.
+func (idx *index) prune(path string) (int, error) {
+	limit := maxVersions(path)
+	if limit == 0 {
+		return 0, nil
+	}
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return 0, err
+	}
+	pinned := make(map[int]bool)
+	for _, l := range labels {
+		if l.path == path {
+			pinned[l.version] = true
+		}
+	}
+
+	// commits are sorted by path and descending version
+	var pruned, kept []*commit
+	count := 0
+	for _, cmt := range idx.commits {
+		if cmt.path == path && !pinned[cmt.version] {
+			if count++; count > limit {
+				pruned = append(pruned, cmt)
+				continue
+			}
+		}
+		kept = append(kept, cmt)
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	bases := make(map[int]int)
+	for _, cmt := range pruned {
+		bases[cmt.version] = cmt.basedOn
+	}
+	for i, cmt := range kept {
+		if cmt.path != path {
+			continue
+		}
+		base, rebased := cmt.basedOn, false
+		for b, ok := bases[base]; ok; b, ok = bases[base] {
+			base, rebased = b, true
+		}
+		if rebased {
+			c := *cmt
+			c.basedOn = base
+			kept[i] = &c
+		}
+	}
+
+	// versions kept are not deltas of pruned ones
+	removed := make(map[*commit]bool)
+	for _, cmt := range pruned {
+		removed[cmt] = true
+	}
+	kept, deltas, err := idx.storeWhole(kept, removed)
+	if err != nil {
+		return 0, err
+	}
+
+	reason := fmt.Sprintf("max-versions %d of %s", limit, path)
+	if _, err := idx.trash(reason, pruned, true); err != nil {
+		return 0, err
+	}
+	if err := idx.writeIndex(kept); err != nil {
+		return 0, err
+	}
+	for _, blob := range deltas {
+		os.Remove(blob)
+	}
+	for _, cmt := range pruned {
+		idx.logEvent("prune", path, cmt.version, reason)
+	}
+	return len(pruned), nil
+}
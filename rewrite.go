@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// forget removes all the versions of the file from the index to the trash
+// and returns the id of the trash entry. The blobs are moved to the trash
+// too unless keepBlobs is set, in which case they stay in the store for
+// archival. The labels and refs of the file go to the trash entry too and
+// come back when it is restored.
+func (idx *index) forget(path string, keepBlobs bool) (string, error) {
+	if err := idx.lock(); err != nil {
+		return "", err
+	}
+	defer idx.unlock()
+
+	// reload, the index may have changed before locking
+	if err := idx.loadCommits(); err != nil {
+		return "", err
+	}
+	var forgotten, kept []*commit
+	for _, cmt := range idx.commits {
+		if cmt.path == path {
+			forgotten = append(forgotten, cmt)
+		} else {
+			kept = append(kept, cmt)
+		}
+	}
+	if len(forgotten) == 0 {
+		return "", fmt.Errorf("%s is not tracked", path)
+	}
+
+	reason := "forget " + path
+	if keepBlobs {
+		reason += ", blobs kept in the store"
+	}
+	id, err := idx.trash(reason, forgotten, !keepBlobs)
+	if err != nil {
+		return "", err
+	}
+	if err := idx.writeIndex(kept); err != nil {
+		return "", err
+	}
+	if err := idx.trashMarks(id, func(p string, _ int) bool { return p == path }); err != nil {
+		return id, fmt.Errorf("failed to trash the labels and refs of %s: %w", path, err)
+	}
+	idx.logEvent("forget", path, 0, id)
+
+	if idx.latestEnabled() {
+		os.Remove(filepath.Join(idx.latestDir(), url.QueryEscape(path)))
+	}
+	if err := idx.replicate(nil); err != nil {
+		return id, fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return id, nil
+}
+
+// uncommit moves the latest version of the file to the trash, with its
+// refs, and returns the id of the trash entry. Labelled versions are not
+// uncommitted.
+func (idx *index) uncommit(path string) (string, error) {
+	if err := idx.lock(); err != nil {
+		return "", err
+	}
+	defer idx.unlock()
+
+	// reload, the index may have changed before locking
+	if err := idx.loadCommits(); err != nil {
+		return "", err
+	}
+	version := idx.currVersion(path)
+	if version == 0 {
+		return "", fmt.Errorf("%s is not tracked", path)
+	}
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return "", err
+	}
+	for _, l := range labels {
+		if l.path == path && l.version == version {
+			return "", fmt.Errorf("version %d of %s has label %s", version, path, l.name)
+		}
+	}
+	var undone *commit
+	var kept []*commit
+	for _, cmt := range idx.commits {
+		if cmt.path == path && cmt.version == version {
+			undone = cmt
+		} else {
+			kept = append(kept, cmt)
+		}
+	}
+
+	id, err := idx.trash(fmt.Sprintf("undo version %d of %s", version, path), []*commit{undone}, true)
+	if err != nil {
+		return "", err
+	}
+	if err := idx.writeIndex(kept); err != nil {
+		return "", err
+	}
+	if err := idx.trashMarks(id, func(p string, v int) bool { return p == path && v == version }); err != nil {
+		return id, fmt.Errorf("failed to trash the refs of version %d of %s: %w", version, path, err)
+	}
+	idx.logEvent("undo", path, version, id)
+
+	if idx.latestEnabled() {
+		if cmt, err := idx.lookup(path, idx.currVersion(path)); err == nil {
+			if err := idx.linkLatest(cmt); err != nil {
+				log.Printf("WARNING: failed to update the latest view: %v", err)
+			}
+		} else {
+			os.Remove(filepath.Join(idx.latestDir(), url.QueryEscape(path)))
+		}
+	}
+	if err := idx.replicate(nil); err != nil {
+		return id, fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return id, nil
+}
+
+// amend replaces the message of the version of the file. The old message
+// is kept in the operation log.
+func (idx *index) amend(path string, version int, message string) error {
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	defer idx.unlock()
+
+	// reload, the index may have changed before locking
+	if err := idx.loadCommits(); err != nil {
+		return err
+	}
+	cmt, err := idx.lookup(path, version)
+	if err != nil {
+		return err
+	}
+	old := cmt.message()
+	amended := *cmt
+	amended.changes = strconv.Quote(message)
+	commits := slices.Clone(idx.commits)
+	commits[slices.Index(commits, cmt)] = &amended
+	if err := idx.writeIndex(commits); err != nil {
+		return err
+	}
+	idx.logEvent("amend", path, version, "was "+old)
+	if err := idx.replicate(nil); err != nil {
+		return fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// shellQuote quotes s for sh(1)
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// exportScript writes a sh(1) script that recreates the history of the
+// file in another store with sgvc commands. The contents of every version
+// are embedded in base64. The working copy is written by the script, so it
+// is saved first and put back at the end. Versions are renumbered without
+// gaps in the new store and bases follow them. Versions keep their times,
+// so the new store must not have later versions of the file.
+func (idx *index) exportScript(w io.Writer, path string) error {
+	commits := slices.Clone(idx.filter(path))
+	if len(commits) == 0 {
+		return fmt.Errorf("no versions for %s", path)
+	}
+	slices.SortFunc(commits, func(a, b *commit) int {
+		return a.version - b.version
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#!/bin/sh\n# history of %s exported by %s at %s\nset -e\n\n",
+		path, toolVersion(), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "f=%s\norig=\"$f.sgvc-orig\"\n", shellQuote(path))
+	fmt.Fprintf(bw, "if [ -e \"$f\" ]; then mv \"$f\" \"$orig\"; fi\n")
+
+	renumbered := make(map[int]int)
+	for i, cmt := range commits {
+		data, err := idx.extract(cmt.path, cmt.version)
+		if err != nil {
+			return fmt.Errorf("version %d: %w", cmt.version, err)
+		}
+		renumbered[cmt.version] = i + 1
+
+		fmt.Fprintf(bw, "\n# version %0*d committed at %s", versionWidth, cmt.version, cmt.when.Format(time.RFC3339))
+		if cmt.author != "" {
+			fmt.Fprintf(bw, " by %s", cmt.author)
+		}
+		fmt.Fprintf(bw, "\nbase64 -d > \"$f\" <<'SGVC_EOF'\n")
+		enc := base64.StdEncoding.EncodeToString(data)
+		for len(enc) > 76 {
+			fmt.Fprintln(bw, enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(bw, "%s\nSGVC_EOF\n", enc)
+		if cmt.mode != 0 {
+			fmt.Fprintf(bw, "chmod %o \"$f\"\n", cmt.mode)
+		}
+		if !cmt.mtime.IsZero() {
+			fmt.Fprintf(bw, "TZ=UTC touch -t %s \"$f\"\n", cmt.mtime.UTC().Format("200601021504.05"))
+		}
+
+		// versions are committed even if unchanged, at their time, and
+		// based on the previous version unless -base is given. A base that
+		// is not in the store any more, like a pruned one, is the previous
+		// version too.
+		args := []string{"sgvc", "-add", shellQuote(cmt.message()), "-force", "-when", cmt.when.UTC().Format(time.RFC3339)}
+		base, ok := renumbered[cmt.basedOn]
+		if !ok && cmt.basedOn != 0 {
+			fmt.Fprintf(bw, "# based on version %0*d, which is not in the store, committed on the previous version\n", versionWidth, cmt.basedOn)
+			base = i
+		}
+		if base != i {
+			args = append(args, "-base", fmt.Sprint(base))
+		}
+		for _, k := range cmt.metaKeys() {
+			args = append(args, "-meta", shellQuote(k+"="+cmt.meta[k]))
+		}
+		fmt.Fprintf(bw, "%s \"$f\"\n", strings.Join(args, " "))
+	}
+
+	fmt.Fprintf(bw, "\nrm \"$f\"\nif [ -e \"$orig\" ]; then mv \"$orig\" \"$f\"; fi\n")
+	return bw.Flush()
+}
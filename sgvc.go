@@ -2,50 +2,163 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
-	// maxVersionLength is used with fmt %*d to print version numbers
-	maxVersionLength = 4
+	// versionWidth is used with fmt %0*d to print version numbers.
+	// It is the minimum width, larger versions are printed in full.
+	versionWidth = 4
 )
 
 // commit represents a new version of a file
 type commit struct {
-	path    string    // the absolute file path
-	when    time.Time // version time
-	version int       // version id
-	basedOn int       // parent version id (optional)
-	pathSig string    // path signature to identify in file store
-	dataCrc uint32    // contents crc for verification
-	changes string    // human readable summary of contents
+	path     string            // the absolute file path
+	when     time.Time         // version time
+	version  int               // version id
+	basedOn  int               // parent version id (optional)
+	pathSig  string            // path signature to identify in file store
+	dataCrc  uint32            // contents crc for verification
+	changes  string            // human readable summary of contents
+	size     int64             // file size at commit time (optional)
+	mtime    time.Time         // file modification time at commit time (optional)
+	mode     os.FileMode       // file permissions at commit time (optional)
+	meta     map[string]string // user supplied key/value pairs (optional)
+	dev      uint64            // device of the file at commit time (optional)
+	ino      uint64            // inode of the file at commit time (optional)
+	author   string            // user who made the commit (optional)
+	xattrs   map[string]string // extended attributes of the file at commit time (optional)
+	encoding string            // encoding of the blob, gzip if compressed, delta if a delta (optional)
+	delta    int               // the version the blob is a delta of, if a delta
+	sum      string            // hex hash of the contents, since store format 8 or in the hash layout (optional)
+	hash     string            // the hash of sum, the hash of the manifest when committed
 
 	descs []*commit // used for the tree output, not serialized
 }
 
-// serialize the commit to a string. Inverse of deserializeCommit
+// contentSize returns the size of the contents, 0 if unknown
+// because it was committed before sizes were recorded
+func (cmt *commit) contentSize() int64 {
+	if cmt.mtime.IsZero() {
+		return 0
+	}
+	return cmt.size
+}
+
+// message returns the commit message, unquoted
+func (cmt *commit) message() string {
+	if m, err := strconv.Unquote(cmt.changes); err == nil {
+		return m
+	}
+	return cmt.changes
+}
+
+// metaKeys returns the sorted keys of the commit metadata
+func (cmt *commit) metaKeys() []string {
+	keys := make([]string, 0, len(cmt.meta))
+	for k := range cmt.meta {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// hasMeta reports whether the commit has all the key/value pairs
+func (cmt *commit) hasMeta(meta map[string]string) bool {
+	for k, v := range meta {
+		if cv, ok := cmt.meta[k]; !ok || cv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// serialize the commit to a string. Inverse of deserializeCommit.
+// The message is quoted like a Go string, so messages of many lines,
+// with tabs or any bytes, keep the line intact and round trip. Every
+// store format quotes it. Optional fields follow as key=value and the
+// last field is the crc of the rest of the line.
 func (cmt *commit) serialize() string {
-	return fmt.Sprintf("%s\t%s\t%0*d\t%0*d\t%s\t%d\t%s",
-		cmt.path, cmt.when.Format(time.RFC3339), maxVersionLength, cmt.version,
-		maxVersionLength, cmt.basedOn, cmt.pathSig, cmt.dataCrc, cmt.changes)
+	s := fmt.Sprintf("%s\t%s\t%0*d\t%0*d\t%s\t%d\t%s",
+		cmt.path, cmt.when.Format(time.RFC3339), versionWidth, cmt.version,
+		versionWidth, cmt.basedOn, cmt.pathSig, cmt.dataCrc, cmt.changes)
+	if !cmt.mtime.IsZero() {
+		s += fmt.Sprintf("\tsize=%d\tmtime=%d", cmt.size, cmt.mtime.UnixNano())
+	}
+	if cmt.mode != 0 {
+		s += fmt.Sprintf("\tmode=%o", cmt.mode)
+	}
+	if cmt.ino != 0 {
+		s += fmt.Sprintf("\tdev=%d\tino=%d", cmt.dev, cmt.ino)
+	}
+	if cmt.author != "" {
+		s += fmt.Sprintf("\tauthor=%s", url.QueryEscape(cmt.author))
+	}
+	if cmt.encoding != "" {
+		s += fmt.Sprintf("\tenc=%s", cmt.encoding)
+	}
+	if cmt.delta != 0 {
+		s += fmt.Sprintf("\tdelta=%d", cmt.delta)
+	}
+	if cmt.sum != "" {
+		s += fmt.Sprintf("\t%s=%s", cmt.hash, cmt.sum)
+	}
+	for _, k := range cmt.metaKeys() {
+		s += fmt.Sprintf("\tmeta.%s=%s", url.QueryEscape(k), url.QueryEscape(cmt.meta[k]))
+	}
+	names := make([]string, 0, len(cmt.xattrs))
+	for name := range cmt.xattrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		s += fmt.Sprintf("\txattr.%s=%s", url.QueryEscape(name), base64.StdEncoding.EncodeToString([]byte(cmt.xattrs[name])))
+	}
+	return fmt.Sprintf("%s\tsum=%08x", s, crc32.ChecksumIEEE([]byte(s)))
 }
 
-// deserializeCommit from a string. Inverse of serialize
+// deserializeCommit from a string. Inverse of serialize.
+// Lines written before store format 2 have no crc and before
+// store format 3 no optional fields. Unknown optional fields are ignored.
 func deserializeCommit(s string) (*commit, error) {
+	if i := strings.LastIndex(s, "\tsum="); i >= 0 {
+		sum, err := strconv.ParseUint(s[i+len("\tsum="):], 16, 32)
+		if err != nil {
+			return nil, errors.New("malformed line crc")
+		}
+		if crc32.ChecksumIEEE([]byte(s[:i])) != uint32(sum) {
+			return nil, errors.New("wrong line crc")
+		}
+		s = s[:i]
+	}
 	parts := strings.Split(s, "\t")
-	if len(parts) != 7 {
+	if len(parts) < 7 {
 		return nil, errors.New("malformed line")
 	}
 
@@ -66,7 +179,7 @@ func deserializeCommit(s string) (*commit, error) {
 		return nil, errors.New("malformed data crc")
 	}
 
-	return &commit{
+	cmt := &commit{
 		path:    parts[0],
 		when:    cwhen,
 		version: cversion,
@@ -74,7 +187,86 @@ func deserializeCommit(s string) (*commit, error) {
 		pathSig: parts[4],
 		dataCrc: uint32(dataCrc),
 		changes: parts[6],
-	}, nil
+	}
+	for _, field := range parts[7:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, errors.New("malformed field")
+		}
+		switch key {
+		case "size":
+			if cmt.size, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, errors.New("malformed size")
+			}
+		case "mtime":
+			mtime, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.New("malformed mtime")
+			}
+			cmt.mtime = time.Unix(0, mtime)
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return nil, errors.New("malformed mode")
+			}
+			cmt.mode = os.FileMode(mode)
+		case "dev":
+			if cmt.dev, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, errors.New("malformed dev")
+			}
+		case "ino":
+			if cmt.ino, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, errors.New("malformed ino")
+			}
+		case "author":
+			if cmt.author, err = url.QueryUnescape(value); err != nil {
+				return nil, errors.New("malformed author")
+			}
+		case "enc":
+			if value != encodingGzip && value != encodingDelta {
+				return nil, errors.New("unknown encoding")
+			}
+			cmt.encoding = value
+		case "delta":
+			if cmt.delta, err = strconv.Atoi(value); err != nil || cmt.delta <= 0 {
+				return nil, errors.New("malformed delta base")
+			}
+		case hashSHA256, hashSHA512:
+			if len(value) != newHash(key).Size()*2 || strings.Trim(value, "0123456789abcdef") != "" {
+				return nil, fmt.Errorf("malformed %s", key)
+			}
+			cmt.sum, cmt.hash = value, key
+		default:
+			if k, ok := strings.CutPrefix(key, "meta."); ok {
+				mk, err := url.QueryUnescape(k)
+				if err != nil {
+					return nil, errors.New("malformed meta key")
+				}
+				mv, err := url.QueryUnescape(value)
+				if err != nil {
+					return nil, errors.New("malformed meta value")
+				}
+				if cmt.meta == nil {
+					cmt.meta = make(map[string]string)
+				}
+				cmt.meta[mk] = mv
+			} else if k, ok := strings.CutPrefix(key, "xattr."); ok {
+				name, err := url.QueryUnescape(k)
+				if err != nil {
+					return nil, errors.New("malformed xattr name")
+				}
+				value, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					return nil, errors.New("malformed xattr value")
+				}
+				if cmt.xattrs == nil {
+					cmt.xattrs = make(map[string]string)
+				}
+				cmt.xattrs[name] = string(value)
+			}
+		}
+	}
+	return cmt, nil
 }
 
 // index represents a file store and an index file for versions
@@ -82,6 +274,12 @@ type index struct {
 	workDir     string    // directory with files
 	commitsFile string    // the index with the serialized commits, a file in workDir
 	commits     []*commit // the commits of the index deserialized from commitsFile
+	quarantined []string  // the lines of commitsFile that failed to deserialize
+	manifest    *manifest // the store description
+
+	// size and modification time of commitsFile when commits were loaded
+	loadedSize    int64
+	loadedModTime time.Time
 }
 
 // getIndex prepares the work directory and initializes the index
@@ -91,26 +289,180 @@ func getIndex() (*index, error) {
 		return nil, err
 	}
 	workDir := filepath.Join(cacheDir, "sgvc")
-	if err := os.MkdirAll(workDir, 0700); err != nil {
+	if store := conf.get("store"); store != "" {
+		workDir = store
+	}
+	if conf.getBool("shared") {
+		dirMode, fileMode, blobMode = os.ModeSetgid|0770, 0660, 0440
+	}
+	if err := mkdirAll(workDir); err != nil {
+		return nil, err
+	}
+	if err := checkAccess(workDir, "r"); err != nil {
 		return nil, err
 	}
 	commitsFile := filepath.Join(workDir, "index")
 	if _, err := os.Stat(commitsFile); os.IsNotExist(err) {
-		f, err := os.Create(commitsFile)
+		// a new store, unless it was created before manifests existed
+		if _, err := os.Stat(manifestFile(workDir)); os.IsNotExist(err) {
+			layout, err := newStoreLayout()
+			if err != nil {
+				return nil, err
+			}
+			hash, err := newStoreHash()
+			if err != nil {
+				return nil, err
+			}
+			m := &manifest{format: storeFormat, writer: toolVersion(), layout: layout, hash: hash}
+			if err := m.write(workDir); err != nil {
+				return nil, err
+			}
+		}
+		f, err := os.OpenFile(commitsFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
 		if err != nil {
 			return nil, err
 		}
+		// the umask may have removed the group bits of a shared store
+		if err := f.Chmod(fileMode); err != nil {
+			f.Close()
+			return nil, err
+		}
 		if err := f.Close(); err != nil {
 			return nil, err
 		}
 	}
-	idx := &index{workDir: workDir, commitsFile: commitsFile}
+	tmpDir = filepath.Join(workDir, "tmp")
+	if err := mkdirAll(tmpDir); err != nil {
+		return nil, err
+	}
+	cleanTemp()
+	mf, err := readManifest(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store manifest: %w", err)
+	}
+	if layout := conf.get("layout"); layout != "" && layout != mf.layout {
+		log.Printf("WARNING: the store has the %s layout, the layout of the configuration applies only to new stores", mf.layout)
+	}
+	if hash := conf.get("hash"); hash != "" && hash != mf.versionHash() {
+		log.Printf("WARNING: the store has the %s hash, the hash of the configuration applies only to new stores", mf.versionHash())
+	}
+	idx := &index{workDir: workDir, commitsFile: commitsFile, manifest: mf}
+	if err := idx.loadCommits(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// openStore opens another store for reading. It is not upgraded,
+// locked or created if missing, only its index cache may be written.
+func openStore(dir string) (*index, error) {
+	commitsFile := filepath.Join(dir, "index")
+	if _, err := os.Stat(commitsFile); err != nil {
+		return nil, fmt.Errorf("%s is not a store: %w", dir, err)
+	}
+	mf := &manifest{format: 1, layout: layoutPath, hash: hashCRC32}
+	if _, err := os.Stat(manifestFile(dir)); err == nil {
+		if mf, err = readManifest(dir); err != nil {
+			return nil, fmt.Errorf("failed to read store manifest: %w", err)
+		}
+	}
+	idx := &index{workDir: dir, commitsFile: commitsFile, manifest: mf}
 	if err := idx.loadCommits(); err != nil {
 		return nil, err
 	}
 	return idx, nil
 }
 
+// hardenStore checks that the work directory and the files in it are owned
+// by the current user and are not accessible by group or others.
+// In a shared store files are owned by many users and accessible by the group,
+// so only the access by others is checked. Blobs must be read only.
+// Modes are fixed when the file is ours, otherwise a warning is printed.
+// Unless all is set only the work directory, the index and the manifest
+// are checked, walking every blob is slow on large stores. The blobs a
+// command reads are verified instead, extractTo checks their hash, so a
+// blob altered through a bad mode is reported by cat, restore and diff.
+func hardenStore(workDir, layout string, all bool) {
+	shared := conf.getBool("shared")
+	forbidden := os.FileMode(0077)
+	if shared {
+		forbidden = 0007
+	}
+	// exact requires the mode, not just the absence of forbidden bits
+	check := func(path string, fi os.FileInfo, mode os.FileMode, exact bool) {
+		uid, ok := fileOwner(fi)
+		if ok && uid != os.Getuid() {
+			if !shared {
+				log.Printf("WARNING: %s is owned by uid %d, not by you. Your history may be tampered", path, uid)
+			} else if fi.Mode().Perm()&forbidden != 0 {
+				log.Printf("WARNING: %s is accessible by others and owned by uid %d who must fix it", path, uid)
+			}
+			return
+		}
+		// the setgid bit of shared directories is part of the mode
+		perm := fi.Mode().Perm()
+		if perm&forbidden != 0 || exact && (perm != mode.Perm() || fi.Mode()&os.ModeSetgid != mode&os.ModeSetgid) {
+			if err := os.Chmod(path, mode); err != nil {
+				log.Printf("WARNING: %s has mode %v and cannot be fixed: %v", path, perm, err)
+			}
+		}
+	}
+
+	fi, err := os.Stat(workDir)
+	if err != nil {
+		log.Printf("WARNING: cannot check permissions of %s: %v", workDir, err)
+		return
+	}
+	// the umask may have removed the group bits of a shared store
+	check(workDir, fi, dirMode, shared)
+	if !all {
+		for _, name := range []string{"index", "manifest"} {
+			path := filepath.Join(workDir, name)
+			if fi, err := os.Stat(path); err == nil {
+				check(path, fi, fileMode, shared)
+			}
+		}
+		return
+	}
+
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		log.Printf("WARNING: cannot check permissions of %s: %v", workDir, err)
+		return
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		switch {
+		case fi.IsDir():
+			check(filepath.Join(workDir, e.Name()), fi, dirMode, shared)
+		case isBlobName(e.Name()):
+			check(filepath.Join(workDir, e.Name()), fi, blobMode, true)
+		default:
+			check(filepath.Join(workDir, e.Name()), fi, fileMode, shared)
+		}
+	}
+	for _, dir := range blobDirs(workDir, layout) {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == dir {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				check(path, fi, dirMode, shared)
+			} else {
+				check(path, fi, blobMode, true)
+			}
+			return nil
+		})
+	}
+}
+
 // loadCommits deserializes the index commits.
 func (idx *index) loadCommits() error {
 	fin, err := os.Open(idx.commitsFile)
@@ -119,7 +471,18 @@ func (idx *index) loadCommits() error {
 	}
 	defer fin.Close()
 
+	fi, err := fin.Stat()
+	if err != nil {
+		return err
+	}
+	idx.loadedSize, idx.loadedModTime = fi.Size(), fi.ModTime()
+	if commits, quarantined, ok := idx.loadCache(fi); ok {
+		idx.commits, idx.quarantined = commits, quarantined
+		return nil
+	}
+
 	var commits []*commit
+	var quarantined []string
 	nlines := 0
 	scanner := bufio.NewScanner(fin)
 	for scanner.Scan() {
@@ -127,7 +490,13 @@ func (idx *index) loadCommits() error {
 		line := scanner.Text()
 		cmt, err := deserializeCommit(line)
 		if err != nil {
-			log.Fatalf("can't load commit:%d: %v", nlines, err)
+			if werr := idx.manifest.writable(); werr != nil {
+				log.Fatalf("can't load commit:%d: %v: %v", nlines, err, werr)
+			}
+			// ignore the damaged line, compact moves it to the quarantine file
+			log.Printf("WARNING: ignoring index line %d: %v. Run sgvc -compact to quarantine it", nlines, err)
+			quarantined = append(quarantined, line)
+			continue
 		}
 		commits = append(commits, cmt)
 	}
@@ -141,10 +510,31 @@ func (idx *index) loadCommits() error {
 		}
 		return b.version - a.version
 	})
-	idx.commits = commits
+	idx.commits, idx.quarantined = commits, quarantined
+	idx.saveCache(fi, commits, quarantined)
 	return nil
 }
 
+// stale reports whether the index file changed since it was loaded
+func (idx *index) stale() (bool, error) {
+	fi, err := os.Stat(idx.commitsFile)
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() != idx.loadedSize || !fi.ModTime().Equal(idx.loadedModTime), nil
+}
+
+// paths returns the tracked files sorted
+func (idx *index) paths() []string {
+	var paths []string
+	for _, cmt := range idx.commits {
+		if len(paths) == 0 || paths[len(paths)-1] != cmt.path {
+			paths = append(paths, cmt.path)
+		}
+	}
+	return paths
+}
+
 // currVersion returns the latest version of a file
 func (idx *index) currVersion(path string) int {
 	v := 0
@@ -156,6 +546,18 @@ func (idx *index) currVersion(path string) int {
 	return v
 }
 
+// versionOrLatest returns the version, or the latest version of the
+// file if it is 0. It exits if the file has no versions.
+func (idx *index) versionOrLatest(path string, version int) int {
+	if version != 0 {
+		return version
+	}
+	if version = idx.currVersion(path); version == 0 {
+		log.Fatalf("no versions for %s", path)
+	}
+	return version
+}
+
 // filter returns the commits for this file.
 // Return all commits if path is the empty string.
 func (idx *index) filter(path string) []*commit {
@@ -174,286 +576,1759 @@ func (idx *index) filter(path string) []*commit {
 
 // filePath returns the file path with the contents of the commit
 func (idx *index) filePath(cmt *commit) string {
-	fname := fmt.Sprintf("%s-%0*d", cmt.pathSig, maxVersionLength, cmt.version)
-	return filepath.Join(idx.workDir, fname)
+	return filepath.Join(idx.workDir, blobName(cmt, idx.manifest.format, idx.manifest.layout))
 }
 
-// extract returns the contents of the version for the file
-func (idx *index) extract(path string, version int) ([]byte, error) {
-	var cmt *commit
+// blobName returns the name, relative to the store, of the file with the
+// contents of the commit in a store of the format and the layout. Before
+// format 4 versions were zero padded and before format 5 there was no extension.
+func blobName(cmt *commit, format int, layout string) string {
+	var name string
+	switch {
+	case format < 4:
+		name = fmt.Sprintf("%s-%0*d", cmt.pathSig, versionWidth, cmt.version)
+	case format < 5:
+		name = fmt.Sprintf("%s-%d", cmt.pathSig, cmt.version)
+	case format < 6 || cmt.encoding == "":
+		name = fmt.Sprintf("%s-%d%s", cmt.pathSig, cmt.version, fileExt(cmt.path))
+	case cmt.encoding == encodingDelta:
+		name = fmt.Sprintf("%s-%d%s.delta", cmt.pathSig, cmt.version, fileExt(cmt.path))
+	default:
+		name = fmt.Sprintf("%s-%d%s.gz", cmt.pathSig, cmt.version, fileExt(cmt.path))
+	}
+	return layoutName(cmt, layout, name)
+}
+
+// fileExt returns the extension of the file name.
+// Unlike filepath.Ext, dotfiles like .bashrc have no extension.
+func fileExt(path string) string {
+	base := filepath.Base(path)
+	if ext := filepath.Ext(base); ext != base {
+		return ext
+	}
+	return ""
+}
+
+// lookup returns the commit of the version for the file
+func (idx *index) lookup(path string, version int) (*commit, error) {
 	for _, c := range idx.commits {
 		if c.path == path && c.version == version {
-			cmt = c
-			break
+			return c, nil
 		}
 	}
-	if cmt == nil {
-		return nil, fmt.Errorf("cannot find version %d for %s", version, path)
-	}
+	return nil, fmt.Errorf("cannot find version %d for %s", version, path)
+}
 
-	data, err := os.ReadFile(idx.filePath(cmt))
-	if err != nil {
+// extract returns the contents of the version for the file
+func (idx *index) extract(path string, version int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := idx.extractTo(&b, path, version); err != nil {
 		return nil, err
 	}
-	if dataCrc := crc32.ChecksumIEEE(data); dataCrc != cmt.dataCrc {
-		return nil, fmt.Errorf("corrupted file, wrong crc: expected %d got %d", cmt.dataCrc, dataCrc)
-	}
-
-	return data, nil
+	return b.Bytes(), nil
 }
 
-// commit writes a new commit to the index
-func (idx *index) commit(path string, basedOn int, changes string) error {
-	data, err := os.ReadFile(path)
+// extractTo copies the contents of the version for the file to w.
+// The hash is computed while copying, so a corrupted file is detected
+// only after all of it has been written to w.
+func (idx *index) extractTo(w io.Writer, path string, version int) error {
+	cmt, err := idx.lookup(path, version)
 	if err != nil {
 		return err
 	}
 
-	currVersion := idx.currVersion(path)
-	if basedOn != 0 && basedOn > currVersion {
-		return fmt.Errorf("invalid base version %d", basedOn)
+	fin, err := idx.openBlob(cmt)
+	if err != nil {
+		return err
 	}
-	thisVersion := currVersion + 1
+	defer fin.Close()
+
+	v := newVerifier(cmt)
+	if _, err := io.Copy(io.MultiWriter(w, v), fin); err != nil {
+		return err
+	}
+	return v.verify()
+}
+
+// statUnchanged reports whether the file has the size and modification
+// time recorded by the commit, so its contents can be assumed unchanged
+// without reading it.
+func statUnchanged(fi os.FileInfo, cmt *commit) bool {
+	return !cmt.mtime.IsZero() && fi.Size() == cmt.size && fi.ModTime().Equal(cmt.mtime)
+}
 
-	pathSig := fmt.Sprintf("%x", sha1.New().Sum([]byte(path)))
-	dataCrc := crc32.ChecksumIEEE(data)
+// versionedName returns the file name with the version before the extension
+func versionedName(path string, version int) string {
+	base := filepath.Base(path)
+	ext := fileExt(base)
+	return fmt.Sprintf("%s.v%0*d%s", strings.TrimSuffix(base, ext), versionWidth, version, ext)
+}
 
-	cmt := commit{
-		path:    path,
-		when:    time.Now(),
-		version: thisVersion,
-		basedOn: basedOn,
-		pathSig: pathSig,
-		dataCrc: dataCrc,
-		changes: strconv.Quote(changes),
+// export writes the version of the file to dir with a versioned name.
+func (idx *index) export(path string, version int, dir string) (string, error) {
+	cmt, err := idx.lookup(path, version)
+	if err != nil {
+		return "", err
 	}
+	fname := filepath.Join(dir, versionedName(path, version))
+	return fname, idx.writeVersion(cmt, fname)
+}
 
-	// first write the file contents
-	fpath := idx.filePath(&cmt)
-	if err := os.WriteFile(fpath, data, 0600); err != nil {
-		return fmt.Errorf("failed to commit contents: %w", err)
+// writeVersion writes the contents of the commit to fname.
+// The mode and the modification time are restored if they were recorded,
+// otherwise the mode of the working copy and the commit time are used.
+func (idx *index) writeVersion(cmt *commit, fname string) error {
+	mode, mtime := cmt.mode, cmt.mtime
+	if mode == 0 {
+		mode = 0644
+		if fi, err := os.Stat(cmt.path); err == nil {
+			mode = fi.Mode().Perm()
+		}
 	}
-	// then write the index entry
-	fout, err := os.OpenFile(idx.commitsFile, os.O_WRONLY|os.O_APPEND|os.O_SYNC, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to open index: %w", err)
+	if mtime.IsZero() {
+		mtime = cmt.when
 	}
-	defer fout.Close()
 
-	_, err = fmt.Fprintln(fout, cmt.serialize())
+	fout, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
-		return fmt.Errorf("failed to commit index: %w", err)
+		return err
 	}
-	return nil
+	prog := newProgress("export", fname, cmt.contentSize())
+	if err := idx.extractTo(io.MultiWriter(fout, prog), cmt.path, cmt.version); err != nil {
+		fout.Close()
+		os.Remove(fname)
+		return err
+	}
+	prog.done()
+	if err := fout.Close(); err != nil {
+		return err
+	}
+	// the mode of an existing file is not changed by OpenFile
+	if err := os.Chmod(fname, mode); err != nil {
+		return err
+	}
+	if err := writeXattrs(fname, cmt.xattrs); err != nil {
+		log.Printf("WARNING: failed to restore extended attributes of %s: %v", fname, err)
+	}
+	return os.Chtimes(fname, mtime, mtime)
 }
 
-// treeOfCommits organizes the index commits as a tree using the base field.
-// It returns a dummy node where every child represents the tree of
-// changes for a file.
-func (idx *index) treeOfCommits(path string) *commit {
-	commits := idx.filter(path)
-
-	type sig struct {
-		path    string
-		version int
+// checkoutAll writes a version of every tracked file under root, at the
+// absolute path of the file. The version is the latest, or the latest
+// committed at or before at if it is not zero, or the labelled version if
+// label is not empty, in which case only the labelled files are written.
+// If paths are given only the files in them are written.
+// It prints the written files and returns how many could not be written.
+func (idx *index) checkoutAll(w io.Writer, root string, at time.Time, label string, paths []string) (int, error) {
+	var commits []*commit
+	if label != "" {
+		labels, err := idx.labelled(label)
+		if err != nil {
+			return 0, err
+		}
+		for _, l := range labels {
+			cmt, err := idx.lookup(l.path, l.version)
+			if err != nil {
+				return 0, err
+			}
+			commits = append(commits, cmt)
+		}
+	} else {
+		times := orderedTimes(idx.commits)
+		// commits are sorted by path and descending version
+		for _, cmt := range idx.commits {
+			if n := len(commits); n > 0 && commits[n-1].path == cmt.path {
+				continue
+			}
+			if !at.IsZero() && times[cmt].After(at) {
+				continue
+			}
+			commits = append(commits, cmt)
+		}
 	}
-	m := make(map[sig]*commit)
-	for _, cmt := range commits {
-		m[sig{cmt.path, cmt.version}] = cmt
+
+	if len(paths) > 0 {
+		commits = slices.DeleteFunc(commits, func(cmt *commit) bool {
+			return !slices.ContainsFunc(paths, func(path string) bool {
+				return inPath(cmt.path, path)
+			})
+		})
 	}
 
-	var dummy commit
+	failed := 0
 	for _, cmt := range commits {
-		if cmt.basedOn > 0 {
-			c := m[sig{cmt.path, cmt.basedOn}]
-			c.descs = append(c.descs, cmt)
-		} else {
-			dummy.descs = append(dummy.descs, cmt)
+		rel := strings.TrimPrefix(cmt.path, filepath.VolumeName(cmt.path))
+		fname := filepath.Join(root, rel)
+		err := os.MkdirAll(filepath.Dir(fname), 0755)
+		if err == nil {
+			err = idx.writeVersion(cmt, fname)
+		}
+		if err != nil {
+			log.Printf("failed to write %s: %v", fname, err)
+			failed++
+			continue
 		}
+		fmt.Fprintf(w, "%s\t%0*d\n", fname, versionWidth, cmt.version)
 	}
-	return &dummy
+	return failed, nil
 }
 
-var tabs = strings.Repeat("\t", 128)
-
-// treePrint descends and prints the tree rooted at cmt.
-func treePrint(cmt *commit, indend int) {
-	fmt.Printf("%s%s\t%s\t%0*d\t%0*d\t%s\n", tabs[0:indend],
-		cmt.path, cmt.when.Format(time.RFC3339),
-		maxVersionLength, cmt.version,
-		maxVersionLength, cmt.basedOn, cmt.changes)
-	for _, dcmt := range cmt.descs {
-		treePrint(dcmt, indend+1)
+// restore overwrites the file with the version. The contents are written
+// and synced to a temp file in the same directory which is renamed over
+// the file, so the file is either the old or the new one. The old file is
+// kept as <file>.sgvc-orig until the rename is synced and put back if that
+// fails.
+func (idx *index) restore(path string, version int) error {
+	cmt, err := idx.lookup(path, version)
+	if err != nil {
+		return err
+	}
+	mode := cmt.mode
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	} else if mode == 0 {
+		mode = 0644
 	}
-}
 
-// diff writes the arguments to temp files and execs diff(1)
-func diff(from, to []byte, labelFrom, labelTo string) error {
-	fromFile, err := os.CreateTemp("", "sgvc")
-	if err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	if err := fromFile.Close(); err != nil {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sgvc-restore-")
+	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(fromFile.Name(), from, 0600); err != nil {
+	defer os.Remove(tmp.Name())
+	prog := newProgress("restore", path, cmt.contentSize())
+	if err := idx.extractTo(io.MultiWriter(tmp, prog), path, version); err != nil {
+		tmp.Close()
 		return err
 	}
-	defer os.Remove(fromFile.Name())
-
-	toFile, err := os.CreateTemp("", "ipdp")
-	if err != nil {
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
 		return err
 	}
-	if err := toFile.Close(); err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
-	if err := os.WriteFile(toFile.Name(), to, 0600); err != nil {
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
 		return err
 	}
-	defer os.Remove(toFile.Name())
+	// some attributes can only be set by root
+	if err := writeXattrs(tmp.Name(), cmt.xattrs); err != nil {
+		log.Printf("WARNING: failed to restore extended attributes of %s: %v", path, err)
+	}
 
-	// run diff but ignore exit status
-	cmd := exec.Command("diff", "-u", "--label", labelFrom, "--label", labelTo,
-		fromFile.Name(), toFile.Name())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
+	orig := path + ".sgvc-orig"
+	if _, err := os.Lstat(orig); err == nil {
+		return fmt.Errorf("%s is left by an interrupted restore, check it and remove it", orig)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		// a copy gets the mode of blobs
+		err := linkOrCopy(path, orig)
+		if err == nil {
+			err = os.Chmod(orig, fi.Mode().Perm())
+		}
+		if err != nil {
+			os.Remove(orig)
+			return fmt.Errorf("failed to keep the old file: %w", err)
+		}
+	} else {
+		orig = ""
+	}
+	rollback := func(err error) error {
+		if orig != "" {
+			if rerr := os.Rename(orig, path); rerr != nil {
+				return fmt.Errorf("%w, and the old file is left in %s: %v", err, orig, rerr)
+			}
+		}
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return rollback(err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return rollback(err)
+	}
+	if orig != "" {
+		os.Remove(orig)
+	}
+	prog.done()
+	idx.logEvent("restore", path, version, "")
 	return nil
 }
 
-var (
-	printCommits  = flag.Bool("commits", false, "print commits")
-	printTree     = flag.Bool("tree", false, "print commits tree")
-	printList     = flag.Bool("list", false, "print tracked files")
-	catVersion    = flag.Int("cat", 0, "print version")
-	commitMessage = flag.String("add", "", "small description of commit")
-	baseVersion   = flag.Int("base", 0, "base version of commit")
-	diffVersions  = flag.Bool("diff", false, "diff versions")
-	diffFrom      = flag.Int("from", 0, "diff from version")
-	diffTo        = flag.Int("to", 0, "diff to version")
-)
-
-func usage() {
-	fmt.Fprintln(os.Stderr, `usage: sgvc [-commits|-tree|-list|-cat|-add|-diff] <file>
-
-sgvc provides version control for single files. You can commit, read, log, diff
-and maintain all the versions of a file. The are no repos. Every file is uniquely identified
-by the absolute path and everything is stored in a single work directory currently $HOME/.cache/sgvc.
-
-Examples:
-$ sgvc -add 'deploy production' deploy.sh
-$ sgvc -commits
-deploy.sh 20240501T00:00:00Z 0001 0000 "deploy production"
-$ sgvc -add 'deploy production with redis' -base 1 deploy.sh
-
-Flags:`)
-	flag.PrintDefaults()
-	os.Exit(2)
-}
-
-func main() {
-	log.SetPrefix("")
-	log.SetFlags(0)
-	flag.Usage = usage
-	flag.Parse()
-
-	idx, err := getIndex()
+// syncDir syncs the directory, so that renames in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer d.Close()
+	return d.Sync()
+}
 
-	var cpath string
-	requiresFile := *commitMessage != "" || *catVersion > 0 || *diffVersions
-	optionalFile := *printList || *printCommits || *printTree
-	if !requiresFile && !optionalFile {
-		usage()
+// restoreLinked overwrites the file with the version without copying it.
+// The file shares the blocks of the stored contents if the filesystem
+// supports reflinks, otherwise it is a hard link of them, read only and
+// never to be edited in place. If neither is possible it is a copy.
+func (idx *index) restoreLinked(path string, version int) error {
+	cmt, err := idx.lookup(path, version)
+	if err != nil {
+		return err
 	}
-	if requiresFile && flag.NArg() != 1 || optionalFile && flag.NArg() > 1 {
-		usage()
+	if err := idx.extractTo(io.Discard, path, version); err != nil {
+		return err
 	}
-	if flag.NArg() == 1 {
-		if cpath, err = filepath.Abs(flag.Arg(0)); err != nil {
-			log.Fatalf("resolution failed: %v", err)
-		}
-		if _, err := os.Stat(cpath); err != nil {
-			log.Fatalf("read failed: %v", err)
-		}
+	if cmt.encoding != "" {
+		// an encoded blob cannot be shared with the working copy
+		return idx.restore(path, version)
 	}
-
-	if *printList {
-		m := make(map[string]string)
-		for _, cmt := range idx.commits {
-			m[cmt.path] = cmt.pathSig
+	blob := idx.filePath(cmt)
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".sgvc-restore-%d", os.Getpid()))
+	os.Remove(tmp)
+	if err := reflink(blob, tmp); err == nil {
+		mode := cmt.mode
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm()
+		} else if mode == 0 {
+			mode = 0644
 		}
-		s := make([]string, 0, len(m))
-		for path := range m {
-			s = append(s, path)
+		if err := os.Chmod(tmp, mode); err != nil {
+			os.Remove(tmp)
+			return err
 		}
-		slices.Sort(s)
-		for _, path := range s {
-			fmt.Println(path, "\t", m[path])
+		if err := writeXattrs(tmp, cmt.xattrs); err != nil {
+			log.Printf("WARNING: failed to restore extended attributes of %s: %v", path, err)
 		}
-		os.Exit(0)
+	} else if err := os.Link(blob, tmp); err != nil {
+		return idx.restore(path, version)
 	}
-
-	if *printCommits {
-		for _, cmt := range idx.filter(cpath) {
-			fmt.Printf("%s\t%s\t%0*d\t%0*d\t%s\n",
-				cmt.path, cmt.when.Format(time.RFC3339),
-				maxVersionLength, cmt.version,
-				maxVersionLength, cmt.basedOn, cmt.changes)
-		}
-		os.Exit(0)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-
-	if *printTree {
-		dummy := idx.treeOfCommits(cpath)
-		for _, cmt := range dummy.descs {
-			treePrint(cmt, 0)
+	idx.logEvent("restore", path, version, "linked")
+	return nil
+}
+
+// modified reports whether the file differs from the commit
+func modified(path string, cmt *commit) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if statUnchanged(fi, cmt) {
+		return false, nil
+	}
+	if !cmt.mtime.IsZero() && fi.Size() != cmt.size {
+		return true, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return !verifyData(cmt, data), nil
+}
+
+// unchanged reports whether the file has the same contents as the
+// commit, compared byte by byte if the crc is the same
+func (idx *index) unchanged(path string, cmt *commit) (bool, error) {
+	if m, err := modified(path, cmt); err != nil || m {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	stored, err := idx.extract(cmt.path, cmt.version)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(data, stored), nil
+}
+
+// prompt returns a short status of the tracked files in the current
+// directory: sgvc:N for N tracked files and sgvc:N*M if M of them are
+// modified. It returns the empty string if no files are tracked.
+func (idx *index) prompt() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	tracked, dirty := 0, 0
+	for i, cmt := range idx.commits {
+		// commits are sorted by path and descending version
+		if i > 0 && idx.commits[i-1].path == cmt.path || filepath.Dir(cmt.path) != dir {
+			continue
 		}
-		os.Exit(0)
+		m, err := modified(cmt.path, cmt)
+		if err != nil {
+			continue
+		}
+		tracked++
+		if m {
+			dirty++
+		}
+	}
+	switch {
+	case tracked == 0:
+		return ""
+	case dirty == 0:
+		return fmt.Sprintf("sgvc:%d", tracked)
+	default:
+		return fmt.Sprintf("sgvc:%d*%d", tracked, dirty)
+	}
+}
+
+// exit codes of -status, distinct from the codes of errors
+const (
+	statusClean     = 0
+	statusModified  = 10
+	statusUntracked = 11
+	statusMissing   = 12
+)
+
+// status returns the status of the file compared with its latest version,
+// clean, modified, untracked or missing, and its exit code. Replaced
+// files are reported too.
+func (idx *index) status(path string) (string, int, error) {
+	fi, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", 0, err
+	}
+	version := idx.currVersion(path)
+	switch {
+	case version == 0 && err != nil:
+		return "", 0, fmt.Errorf("%s is not tracked and does not exist", path)
+	case version == 0:
+		return "untracked", statusUntracked, nil
+	case err != nil:
+		return "missing", statusMissing, nil
+	}
+	cmt, err := idx.lookup(path, version)
+	if err != nil {
+		return "", 0, err
+	}
+	m, err := modified(path, cmt)
+	if err != nil {
+		return "", 0, err
+	}
+	status, code := "clean", statusClean
+	if m {
+		status, code = "modified", statusModified
 	}
+	if idx.replaced(path, fi, cmt) {
+		status += fmt.Sprintf(", replaced by another file since version %0*d", versionWidth, version)
+	}
+	return status, code, nil
+}
 
-	if *commitMessage != "" {
-		if err := idx.commit(cpath, *baseVersion, *commitMessage); err != nil {
-			log.Fatal(err)
+// replaced reports whether the file is not the file of the commit but a
+// different one in the same path, as happens when editors and configuration
+// managers write a new file and rename it over the old. Files with the
+// contents of a version are not reported, sgvc restores versions that way too.
+func (idx *index) replaced(path string, fi os.FileInfo, cmt *commit) bool {
+	dev, ino, ok := fileID(fi)
+	if !ok || cmt.ino == 0 || (dev == cmt.dev && ino == cmt.ino) {
+		return false
+	}
+	matches, err := idx.identify(path)
+	return err != nil || len(matches) == 0
+}
+
+// grep prints the lines of the version of the file that match the
+// regular expression, prefixed by their line number, and returns
+// the number of matching lines
+func (idx *index) grep(w io.Writer, path string, version int, re *regexp.Regexp) (int, error) {
+	data, err := idx.extract(path, version)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	matches := 0
+	for n, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if re.MatchString(line) {
+			fmt.Fprintf(bw, "%d:%s\n", n+1, line)
+			matches++
 		}
-		os.Exit(0)
 	}
+	return matches, bw.Flush()
+}
 
-	if *catVersion > 0 {
-		data, err := idx.extract(cpath, *catVersion)
+// identify returns the versions of the file whose contents are equal
+// to the contents of the file
+func (idx *index) identify(path string) ([]*commit, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := newDigests(data)
+
+	var matches []*commit
+	for _, cmt := range idx.filter(path) {
+		if !d.matches(cmt) {
+			continue
+		}
+		if statUnchanged(fi, cmt) {
+			matches = append(matches, cmt)
+			continue
+		}
+		stored, err := idx.extract(cmt.path, cmt.version)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		if bytes.Equal(stored, data) {
+			matches = append(matches, cmt)
 		}
-		os.Stdout.Write(data)
-		os.Exit(0)
 	}
+	return matches, nil
+}
 
-	if *diffVersions {
-		load := func(path string, version int) (label string, data []byte, err error) {
-			if version > 0 {
-				data, err = idx.extract(cpath, version)
-				label = fmt.Sprintf("%s @%0*d", cpath, maxVersionLength, version)
-			} else {
-				data, err = os.ReadFile(cpath)
-				label = cpath
+// verify checks the stored contents of every version of the file against
+// the recorded crc and that every base version exists.
+// It returns a description of every problem found.
+func (idx *index) verify(path string) []string {
+	var problems []string
+	versions := make(map[int]bool)
+	commits := idx.filter(path)
+	for _, cmt := range commits {
+		if versions[cmt.version] {
+			problems = append(problems, fmt.Sprintf("%0*d: duplicate version", versionWidth, cmt.version))
+		}
+		versions[cmt.version] = true
+	}
+	for _, cmt := range commits {
+		if err := idx.extractTo(io.Discard, cmt.path, cmt.version); err != nil {
+			problems = append(problems, fmt.Sprintf("%0*d: %v", versionWidth, cmt.version, err))
+		}
+		if cmt.basedOn >= cmt.version {
+			problems = append(problems, fmt.Sprintf("%0*d: base version %d is not older", versionWidth, cmt.version, cmt.basedOn))
+		} else if cmt.basedOn > 0 && !versions[cmt.basedOn] {
+			problems = append(problems, fmt.Sprintf("%0*d: base version %d does not exist", versionWidth, cmt.version, cmt.basedOn))
+		}
+	}
+	return problems
+}
+
+// pathSignature returns the signature of the path used to name its blobs
+func pathSignature(path string) string {
+	return fmt.Sprintf("%x", sha1.New().Sum([]byte(path)))
+}
+
+// commit writes a new commit of the file to the index
+func (idx *index) commit(path string, basedOn int, changes string, meta map[string]string) error {
+	// stat before reading, a file modified while reading gets a newer mtime
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	prog := newProgress("commit", path, fi.Size())
+	data, err := readFile(path, prog)
+	if err != nil {
+		return err
+	}
+	return idx.commitContents(path, data, fi, basedOn, changes, meta, prog)
+}
+
+// commitReader writes a new commit with the contents read from r to the
+// index. The path names data that is not a file, like the output of a
+// command, and need not exist. Checks and the attributes of files are
+// not recorded.
+func (idx *index) commitReader(path string, r io.Reader, basedOn int, changes string, meta map[string]string) error {
+	prog := newProgress("commit", path, 0)
+	data, err := io.ReadAll(io.TeeReader(r, prog))
+	if err != nil {
+		return err
+	}
+	return idx.commitContents(path, data, nil, basedOn, changes, meta, prog)
+}
+
+// commitContents writes a new commit with the data to the index. fi is
+// the file the data was read from, nil if the data is not a file.
+func (idx *index) commitContents(path string, data []byte, fi os.FileInfo, basedOn int, changes string, meta map[string]string, prog *progress) error {
+	p := &pending{path: path, data: data, fi: fi, basedOn: basedOn, changes: changes, meta: meta, prog: prog}
+	return idx.commitBatch([]*pending{p}, true)
+}
+
+// maxWorkers bounds the files hashed and written to the store at once
+const maxWorkers = 8
+
+// pending is a version to commit with commitBatch
+type pending struct {
+	path    string
+	data    []byte      // the contents, read from path if read is set
+	read    bool        // read the contents and fi from path
+	fi      os.FileInfo // the file the data was read from, nil if not a file
+	basedOn int
+	latest  bool // basedOn must still be the latest version
+	changes string
+	meta    map[string]string
+	prog    *progress
+
+	cmt *commit // the commit, set if committed
+	err error   // why it was not committed
+
+	tmp      string // the blob, written before locking
+	blob     string // the blob renamed from tmp, removed if the batch fails
+	encoding string
+	delta    int    // the delta base, if encoding is delta
+	ops      []byte // the instructions of the delta
+	deltaSum string // the hash of the delta base
+	hash     string // the hash of the store, set when committed
+	sum      string
+}
+
+// pendingFile returns the pending version of the file, read when committed
+func pendingFile(path string, basedOn int, changes string, meta map[string]string) *pending {
+	return &pending{path: path, read: true, basedOn: basedOn, changes: changes, meta: meta}
+}
+
+// stage reads the contents of the pending version, runs its checks and
+// writes its blob to a temp file of the store
+func (idx *index) stage(p *pending) error {
+	if p.read {
+		// stat before reading, a file modified while reading gets a newer mtime
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			return err
+		}
+		p.fi, p.prog = fi, newProgress("commit", p.path, fi.Size())
+		if p.data, err = readFile(p.path, p.prog); err != nil {
+			return err
+		}
+	}
+	policy, err := storagePolicy(p.path)
+	if err != nil {
+		return err
+	}
+	if policy == storeReject {
+		return fmt.Errorf("the storage policy rejects %s", p.path)
+	}
+	if limit := maxSize(p.path); limit > 0 && int64(len(p.data)) > limit {
+		return fmt.Errorf("%s has %d bytes, more than the max-size %d", p.path, len(p.data), limit)
+	}
+	switch policy {
+	case storeCompress:
+		p.encoding = encodingGzip
+	case storeDelta:
+		p.encoding = encodingGzip
+		if cmt, base := idx.deltaBase(p); cmt != nil {
+			// a delta is stored only if it is much smaller
+			if ops := makeDelta(base, p.data); len(ops) < len(p.data)/2 {
+				_, p.deltaSum = cmt.digest()
+				p.encoding, p.delta, p.ops = encodingDelta, cmt.version, ops
+			}
+		}
+	}
+	p.sum = hashSum(p.hash, p.data)
+	// checks may be slow, they run before locking
+	var checks map[string]string
+	if p.fi != nil {
+		checks = runChecks(p.path)
+	}
+	ctx := commitContext()
+	if len(checks) > 0 || len(ctx) > 0 {
+		p.meta = maps.Clone(p.meta)
+		if p.meta == nil {
+			p.meta = make(map[string]string)
+		}
+		maps.Copy(p.meta, ctx)
+		maps.Copy(p.meta, checks)
+	}
+
+	// the name of the blob depends on the version, it is renamed when locked
+	tmp, err := createTemp()
+	if err != nil {
+		return fmt.Errorf("failed to commit contents: %w", err)
+	}
+	p.tmp = tmp.Name()
+	if p.encoding == encodingDelta {
+		err = encodeBlob(tmp, p.ops, p.encoding)
+	} else {
+		err = encodeBlob(tmp, p.data, p.encoding)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(p.tmp, blobMode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to commit contents: %w", err)
+	}
+	return nil
+}
+
+// commitBatch commits the pending versions. Their contents are read,
+// checked and written to the store by a bounded pool of workers, and
+// then all their lines are appended to the index at once with the store
+// locked. If all is set nothing is committed unless every version can be,
+// otherwise the versions that fail are skipped with their err set.
+func (idx *index) commitBatch(batch []*pending, all bool) error {
+	defer func() {
+		for _, p := range batch {
+			if p.tmp != "" {
+				os.Remove(p.tmp)
+			}
+		}
+	}()
+	failed := func(p *pending) error {
+		if len(batch) > 1 && !strings.Contains(p.err.Error(), p.path) {
+			return fmt.Errorf("%s: %w", p.path, p.err)
+		}
+		return p.err
+	}
+
+	jobs := make(chan *pending)
+	var wg sync.WaitGroup
+	for i := 0; i < min(len(batch), maxWorkers, runtime.GOMAXPROCS(0)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				p.err = idx.stage(p)
+			}
+		}()
+	}
+	for _, p := range batch {
+		p.hash = idx.manifest.versionHash()
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	for _, p := range batch {
+		if p.err != nil && all {
+			return failed(p)
+		}
+	}
+
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	err := idx.commitStaged(batch, all, failed)
+	idx.unlock()
+	// hooks may run sgvc, they run with the store unlocked
+	for _, p := range batch {
+		if p.cmt != nil {
+			runHooks(p.cmt, p.changes)
+		}
+	}
+	return err
+}
+
+// commitStaged commits the staged versions of the batch with the store
+// locked. The versions committed have their cmt set, even on errors after
+// their index lines are appended.
+func (idx *index) commitStaged(batch []*pending, all bool, failed func(*pending) error) error {
+	// another sgvc may have appended to the index since it was loaded.
+	// Reload until the index is unchanged so that versions are never reused.
+	for attempts := 0; ; attempts++ {
+		stale, err := idx.stale()
+		if err != nil {
+			return fmt.Errorf("failed to check index: %w", err)
+		}
+		if !stale {
+			break
+		}
+		if attempts == 10 {
+			return errors.New("index is modified concurrently, try again")
+		}
+		if err := idx.loadCommits(); err != nil {
+			return fmt.Errorf("failed to reload index: %w", err)
+		}
+	}
+
+	// the latest versions, with the versions of the batch
+	latest := make(map[string]*commit)
+	version := func(path string) (int, *commit) {
+		if cmt, ok := latest[path]; ok {
+			return cmt.version, cmt
+		}
+		v := idx.currVersion(path)
+		cmt, _ := idx.lookup(path, v)
+		return v, cmt
+	}
+	// versions are committed only if their index lines are appended
+	abandon := func() {
+		for _, p := range batch {
+			if p.blob != "" {
+				os.Remove(p.blob)
+			}
+			p.cmt = nil
+		}
+	}
+	var commits []*commit
+	for _, p := range batch {
+		if p.err != nil {
+			continue
+		}
+		if p.cmt, p.err = idx.newCommit(p, version); p.err != nil {
+			if all {
+				abandon()
+				return failed(p)
+			}
+			continue
+		}
+		latest[p.path] = p.cmt
+		commits = append(commits, p.cmt)
+	}
+	var lines []string
+	for _, p := range batch {
+		if p.cmt == nil {
+			continue
+		}
+		// the store failing fails the whole batch
+		if p.err = idx.storeBlob(p); p.err != nil {
+			abandon()
+			return failed(p)
+		}
+		lines = append(lines, p.cmt.serialize())
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	// then write the index entries
+	if err := appendLines(idx.commitsFile, lines); err != nil {
+		abandon()
+		return fmt.Errorf("failed to commit index: %w", err)
+	}
+
+	pruneable := false
+	for _, p := range batch {
+		if p.cmt == nil {
+			continue
+		}
+		p.prog.done()
+		idx.logEvent("commit", p.path, p.cmt.version, p.changes)
+		if idx.latestEnabled() {
+			if err := idx.linkLatest(p.cmt); err != nil {
+				log.Printf("WARNING: failed to update the latest view: %v", err)
+			}
+		}
+		pruneable = pruneable || maxVersions(p.path) > 0
+	}
+	// mirrorCommit copies only the last line of the index
+	var mirrored *commit
+	if len(commits) == 1 {
+		mirrored = commits[0]
+	}
+	if pruneable {
+		if err := idx.loadCommits(); err != nil {
+			return fmt.Errorf("failed to reload index: %w", err)
+		}
+		for path := range latest {
+			pruned, err := idx.prune(path)
+			if err != nil {
+				return fmt.Errorf("committed version %d of %s but failed to prune old versions: %w", latest[path].version, path, err)
+			}
+			if pruned > 0 {
+				// the index was rewritten, the mirror needs all of it
+				mirrored = nil
+			}
+		}
+	}
+	if err := idx.replicate(mirrored); err != nil {
+		if mirrored != nil {
+			return fmt.Errorf("committed version %d but failed to mirror it, run sgvc -mirror: %w", mirrored.version, err)
+		}
+		return fmt.Errorf("committed %d versions but failed to mirror them, run sgvc -mirror: %w", len(commits), err)
+	}
+	return nil
+}
+
+// newCommit returns the commit of the pending version. version returns
+// the latest version of a file, and its commit if it has one.
+func (idx *index) newCommit(p *pending, version func(string) (int, *commit)) (*commit, error) {
+	currVersion, latest := version(p.path)
+	if p.basedOn != 0 && p.basedOn > currVersion {
+		return nil, fmt.Errorf("invalid base version %d", p.basedOn)
+	}
+	if p.latest && p.basedOn != currVersion {
+		return nil, fmt.Errorf("%s has version %d since version %d it is based on", p.path, currVersion, p.basedOn)
+	}
+	if p.delta != 0 {
+		// the base may have been removed, and its number reused, since staging
+		var sum string
+		if base, err := idx.lookup(p.path, p.delta); err == nil {
+			_, sum = base.digest()
+		}
+		if sum != p.deltaSum {
+			return nil, fmt.Errorf("version %d of %s changed while committing a delta of it, try again", p.delta, p.path)
+		}
+	}
+	thisVersion := currVersion + 1
+	when := time.Now()
+	if !commitTime.IsZero() {
+		// versions are in the order of their times, like in -timeline, except
+		// versions based on an older version, which are ordered by their numbers
+		if latest != nil && commitTime.Before(latest.when) {
+			base, err := idx.lookup(p.path, p.basedOn)
+			if p.basedOn == 0 || p.basedOn == currVersion || err != nil || commitTime.Before(base.when) {
+				return nil, fmt.Errorf("cannot backdate version %d of %s to %s, before version %d at %s, unless based on an older version before it",
+					thisVersion, p.path, commitTime.Format(time.RFC3339), currVersion, latest.when.Format(time.RFC3339))
 			}
+		}
+		when = commitTime
+	} else if latest != nil && when.Before(latest.when) {
+		// a clock behind the latest version, a little or of another machine
+		if skew := latest.when.Sub(when); skew <= maxClockSkew() {
+			when = latest.when
+		} else {
+			log.Printf("WARNING: the clock is %v behind version %d of %s, versions are ordered by their numbers", skew.Round(time.Second), currVersion, p.path)
+		}
+	}
+
+	cmt := &commit{
+		path:     p.path,
+		when:     when,
+		version:  thisVersion,
+		basedOn:  p.basedOn,
+		pathSig:  pathSignature(p.path),
+		dataCrc:  crc32.ChecksumIEEE(p.data),
+		changes:  strconv.Quote(p.changes),
+		size:     int64(len(p.data)),
+		meta:     p.meta,
+		author:   currentUser(),
+		encoding: p.encoding,
+		delta:    p.delta,
+		sum:      p.sum,
+		hash:     p.hash,
+	}
+	if p.fi == nil {
+		// the size is recorded with an mtime
+		cmt.mtime = cmt.when
+	} else {
+		cmt.size, cmt.mtime, cmt.mode = p.fi.Size(), p.fi.ModTime(), p.fi.Mode().Perm()
+		cmt.dev, cmt.ino, _ = fileID(p.fi)
+		if conf.getBool("xattrs") {
+			var err error
+			if cmt.xattrs, err = readXattrs(p.path); err != nil {
+				return nil, fmt.Errorf("failed to read extended attributes: %w", err)
+			}
+		}
+	}
+	return cmt, nil
+}
+
+// storeBlob renames the blob of the pending version to the name of its
+// commit
+func (idx *index) storeBlob(p *pending) error {
+	blob := idx.filePath(p.cmt)
+	if err := mkdirAll(filepath.Dir(blob)); err != nil {
+		return fmt.Errorf("failed to commit contents: %w", err)
+	}
+	// in the hash layout identical contents are stored once
+	if _, err := os.Stat(blob); err != nil || idx.manifest.layout != layoutHash {
+		if err := os.Rename(p.tmp, blob); err != nil {
+			return fmt.Errorf("failed to commit contents: %w", err)
+		}
+		p.tmp, p.blob = "", blob
+	}
+	return nil
+}
+
+// appendLines appends lines to the file and syncs it. If the file does not
+// end with a newline, because of an interrupted write, a newline is added
+// first so that the partial line does not corrupt the new ones.
+func appendLines(fname string, lines []string) error {
+	fout, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, fileMode)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+
+	var b strings.Builder
+	fi, err := fout.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := fout.ReadAt(last, fi.Size()-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			b.WriteString("\n")
+		}
+	}
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	if _, err := fout.WriteString(b.String()); err != nil {
+		return err
+	}
+	return fout.Close()
+}
+
+// compact rewrites the index sorted by path and version, with every
+// line normalized and duplicate entries dropped. The old index is kept
+// as a backup whose path is returned.
+func (idx *index) compact() (string, error) {
+	if err := idx.lock(); err != nil {
+		return "", err
+	}
+	defer idx.unlock()
+
+	// reload, the index may have changed before locking
+	if err := idx.loadCommits(); err != nil {
+		return "", err
+	}
+	commits := slices.Clone(idx.commits)
+	slices.SortFunc(commits, func(a, b *commit) int {
+		if c := strings.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return a.version - b.version
+	})
+	// duplicate entries share the blob of the kept entry
+	var dups []*commit
+	commits = slices.CompactFunc(commits, func(a, b *commit) bool {
+		if a.path == b.path && a.version == b.version {
+			dups = append(dups, b)
+			return true
+		}
+		return false
+	})
+	if len(dups) > 0 {
+		if _, err := idx.trash("compact: duplicate entries", dups, false); err != nil {
+			return "", fmt.Errorf("failed to trash duplicate entries: %w", err)
+		}
+	}
+
+	old, err := os.ReadFile(idx.commitsFile)
+	if err != nil {
+		return "", err
+	}
+	backup := idx.commitsFile + "." + time.Now().Format("20060102T150405") + ".bak"
+	if err := os.WriteFile(backup, old, fileMode); err != nil {
+		return "", fmt.Errorf("failed to backup index: %w", err)
+	}
+	if len(idx.quarantined) > 0 {
+		if err := appendLines(idx.commitsFile+".quarantine", idx.quarantined); err != nil {
+			return "", fmt.Errorf("failed to quarantine damaged lines: %w", err)
+		}
+		idx.quarantined = nil
+	}
+	if err := idx.writeIndex(commits); err != nil {
+		return "", err
+	}
+	idx.logEvent("compact", "", 0, "old index saved in "+backup)
+	if err := idx.replicate(nil); err != nil {
+		return "", fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return backup, nil
+}
+
+// writeIndex replaces the index with the commits, sorted by path and
+// version, followed by the quarantined lines. It must be called with the
+// store locked. The new index is written to a temp file which is renamed
+// over the index, so the index is either the old or the new one.
+func (idx *index) writeIndex(commits []*commit) error {
+	commits = slices.Clone(commits)
+	slices.SortFunc(commits, func(a, b *commit) int {
+		if c := strings.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return a.version - b.version
+	})
+
+	tmp, err := createTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, cmt := range commits {
+		fmt.Fprintln(w, cmt.serialize())
+	}
+	for _, line := range idx.quarantined {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), idx.commitsFile); err != nil {
+		return err
+	}
+	return idx.loadCommits()
+}
+
+// treeOfCommits organizes the index commits as a tree using the base field.
+// It returns a dummy node where every child represents the tree of
+// changes for a file.
+func (idx *index) treeOfCommits(path string) *commit {
+	commits := idx.filter(path)
+
+	type sig struct {
+		path    string
+		version int
+	}
+	m := make(map[sig]*commit)
+	for _, cmt := range commits {
+		m[sig{cmt.path, cmt.version}] = cmt
+	}
+
+	// the base of a commit may have been pruned or forgotten
+	var dummy commit
+	for _, cmt := range commits {
+		if c := m[sig{cmt.path, cmt.basedOn}]; c != nil {
+			c.descs = append(c.descs, cmt)
+		} else {
+			dummy.descs = append(dummy.descs, cmt)
+		}
+	}
+	return &dummy
+}
+
+// printCommit prints the commit in the -commits format.
+// Metadata follow as key=value.
+func printCommit(cmt *commit) {
+	var meta strings.Builder
+	if cmt.author != "" {
+		fmt.Fprintf(&meta, "\tauthor=%s", cmt.author)
+	}
+	for _, k := range cmt.metaKeys() {
+		fmt.Fprintf(&meta, "\t%s=%s", k, cmt.meta[k])
+	}
+	fmt.Printf("%s\t%s\t%0*d\t%0*d\t%s%s\n",
+		cmt.path, cmt.when.Format(time.RFC3339),
+		versionWidth, cmt.version,
+		versionWidth, cmt.basedOn, cmt.changes, meta.String())
+}
+
+var tabs = strings.Repeat("\t", 128)
+
+// minCollapse is the minimum number of versions in a linear run
+// that treePrint collapses to a single line
+const minCollapse = 3
+
+// treePrint descends and prints the tree rooted at cmt.
+// Unless full is set, linear runs of versions with a single
+// descendant are collapsed to a summary line.
+func treePrint(cmt *commit, indend int, full bool) {
+	fmt.Printf("%s%s\t%s\t%0*d\t%0*d\t%s\n", tabs[0:min(indend, len(tabs))],
+		cmt.path, cmt.when.Format(time.RFC3339),
+		versionWidth, cmt.version,
+		versionWidth, cmt.basedOn, cmt.changes)
+
+	if !full {
+		var run []*commit
+		for c := cmt; len(c.descs) == 1; c = c.descs[0] {
+			run = append(run, c.descs[0])
+		}
+		// keep the last version of the run, it is a branch point or a leaf
+		if len(run)-1 >= minCollapse {
+			first, last := run[0], run[len(run)-2]
+			fmt.Printf("%s%0*d…%0*d, %d versions\n", tabs[0:min(indend+1, len(tabs))],
+				versionWidth, first.version, versionWidth, last.version, len(run)-1)
+			treePrint(run[len(run)-1], indend+2, full)
 			return
 		}
+	}
+	for _, dcmt := range cmt.descs {
+		treePrint(dcmt, indend+1, full)
+	}
+}
 
-		labelFrom, from, err := load(cpath, *diffFrom)
+// dedupe prints the groups of commits whose contents are identical but
+// are stored in different files. It returns the number of bytes that would
+// be saved by storing every group once. Versions that share a file, like
+// in the hash layout, are stored once already.
+func (idx *index) dedupe(w io.Writer, commits []*commit) (int64, error) {
+	// the commits of every stored file, candidates must have the same crc
+	type blob struct {
+		path    string
+		size    int64
+		commits []*commit
+	}
+	blobs := make(map[string]*blob)
+	candidates := make(map[uint32][]*blob)
+	for _, cmt := range commits {
+		path := idx.filePath(cmt)
+		if b, ok := blobs[path]; ok {
+			b.commits = append(b.commits, cmt)
+			continue
+		}
+		fi, err := os.Stat(path)
 		if err != nil {
-			log.Fatalf("failed to resolve diff from: %v", err)
+			return 0, err
+		}
+		b := &blob{path, fi.Size(), []*commit{cmt}}
+		blobs[path] = b
+		candidates[cmt.dataCrc] = append(candidates[cmt.dataCrc], b)
+	}
+	type group struct {
+		sum   string
+		size  int64
+		blobs []*blob
+	}
+	var groups []*group
+	for _, bs := range candidates {
+		if len(bs) < 2 {
+			continue
+		}
+		// stored contents may be compressed, compare the contents
+		bySum := make(map[string]*group)
+		var sums []string
+		for _, b := range bs {
+			sum, size, err := idx.contentSum(b.commits[0])
+			if err != nil {
+				return 0, err
+			}
+			g, ok := bySum[sum]
+			if !ok {
+				g = &group{sum: sum, size: size}
+				bySum[sum] = g
+				sums = append(sums, sum)
+			}
+			g.blobs = append(g.blobs, b)
 		}
-		labelTo, to, err := load(cpath, *diffTo)
+		for _, sum := range sums {
+			if g := bySum[sum]; len(g.blobs) > 1 {
+				groups = append(groups, g)
+			}
+		}
+	}
+	slices.SortFunc(groups, func(a, b *group) int {
+		if c := cmp.Compare(b.size, a.size); c != 0 {
+			return c
+		}
+		return strings.Compare(a.sum, b.sum)
+	})
+
+	var saved int64
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\t%d bytes\t%d copies\n", g.sum, g.size, len(g.blobs))
+		// keeping the smallest copy saves the others
+		slices.SortFunc(g.blobs, func(a, b *blob) int {
+			return cmp.Compare(a.size, b.size)
+		})
+		for i, b := range g.blobs {
+			for _, cmt := range b.commits {
+				fmt.Fprintf(w, "\t%s @%0*d\n", cmt.path, versionWidth, cmt.version)
+			}
+			if i > 0 {
+				saved += b.size
+			}
+		}
+	}
+	return saved, nil
+}
+
+// findHash returns the commits whose contents have the sha256. A prefix
+// of the hex sha256 is enough.
+func (idx *index) findHash(sum string) ([]*commit, error) {
+	sum = strings.ToLower(sum)
+	if len(sum) == 0 || len(sum) > sha256.Size*2 || strings.Trim(sum, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("invalid sha256 %q", sum)
+	}
+	var matches []*commit
+	for _, cmt := range idx.commits {
+		s, _, err := idx.contentSum(cmt)
 		if err != nil {
-			log.Fatalf("failed to resolve diff to: %v", err)
+			log.Printf("WARNING: cannot read version %d of %s: %v", cmt.version, cmt.path, err)
+			continue
 		}
-		if err := diff(from, to, labelFrom, labelTo); err != nil {
-			log.Fatalf("failed to diff: %v", err)
+		if strings.HasPrefix(s, sum) {
+			matches = append(matches, cmt)
+		}
+	}
+	return matches, nil
+}
+
+// growth prints the number of commits and the bytes added per month
+func (idx *index) growth(w io.Writer, commits []*commit) error {
+	type month struct {
+		commits int
+		bytes   int64
+	}
+	months := make(map[string]*month)
+	for _, cmt := range commits {
+		size := cmt.size
+		if cmt.mtime.IsZero() {
+			fi, err := os.Stat(idx.filePath(cmt))
+			if err != nil {
+				return err
+			}
+			size = fi.Size()
+		}
+		key := cmt.when.Format("2006-01")
+		if months[key] == nil {
+			months[key] = &month{}
+		}
+		months[key].commits++
+		months[key].bytes += size
+	}
+
+	keys := make([]string, 0, len(months))
+	for k := range months {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var total int64
+	for _, k := range keys {
+		m := months[k]
+		total += m.bytes
+		fmt.Fprintf(w, "%s\t%d commits\t%d bytes\t%d bytes total\n", k, m.commits, m.bytes, total)
+	}
+	return nil
+}
+
+// textStats returns the number of words and lines of data
+func textStats(data []byte) (words, lines int) {
+	words = len(bytes.Fields(data))
+	lines = bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lines++
+	}
+	return
+}
+
+// diffOptions control how versions are compared
+type diffOptions struct {
+	raw     bool   // diff raw contents, without converting to text
+	imgdiff string // file to write a visual diff of images
+	key     int    // key column of csv and tsv files
+}
+
+// diffFile writes the diff between two versions of the file to w.
+// Version 0 is the working copy.
+func (idx *index) diffFile(w io.Writer, path string, fromVersion, toVersion int, opts diffOptions) error {
+	load := func(version int) (label string, data []byte, err error) {
+		if version > 0 {
+			data, err = idx.extract(path, version)
+			label = fmt.Sprintf("%s @%0*d", path, versionWidth, version)
+		} else {
+			data, err = os.ReadFile(path)
+			label = path
+		}
+		return
+	}
+
+	labelFrom, from, err := load(fromVersion)
+	if err != nil {
+		return fmt.Errorf("failed to resolve diff from: %w", err)
+	}
+	labelTo, to, err := load(toVersion)
+	if err != nil {
+		return fmt.Errorf("failed to resolve diff to: %w", err)
+	}
+	if !opts.raw {
+		isImage, err := imageDiff(w, from, to, labelFrom, labelTo, opts.imgdiff)
+		if err != nil {
+			return fmt.Errorf("failed to diff images: %w", err)
 		}
-		os.Exit(0)
+		if isImage {
+			return nil
+		}
+		if isTable(path) {
+			if err := tableDiff(w, path, from, to, labelFrom, labelTo, opts.key); err != nil {
+				return fmt.Errorf("failed to diff tables: %w", err)
+			}
+			return nil
+		}
+		if from, err = textconv(path, from); err != nil {
+			return fmt.Errorf("failed to convert diff from: %w", err)
+		}
+		if to, err = textconv(path, to); err != nil {
+			return fmt.Errorf("failed to convert diff to: %w", err)
+		}
+		from, to = wordLines(path, from), wordLines(path, to)
+	}
+	return diff(w, from, to, labelFrom, labelTo)
+}
+
+// historyDiff writes the diff of every version of the file with its
+// parent, its base or else the previous version, oldest first. If dir
+// is not empty every diff is written to its own file there instead and
+// the names of the files are written to w.
+func (idx *index) historyDiff(w io.Writer, path string, opts diffOptions, dir string) error {
+	commits := slices.Clone(idx.filter(path))
+	if len(commits) == 0 {
+		return fmt.Errorf("no versions for %s", path)
+	}
+	slices.Reverse(commits)
+	exists := make(map[int]bool)
+	for i, cmt := range commits {
+		parent := 0
+		if exists[cmt.basedOn] {
+			parent = cmt.basedOn
+		} else if i > 0 {
+			parent = commits[i-1].version
+		}
+		exists[cmt.version] = true
+
+		out := w
+		var fout *os.File
+		if dir != "" {
+			fname := filepath.Join(dir, strings.TrimSuffix(versionedName(path, cmt.version), fileExt(path))+".diff")
+			var err error
+			if fout, err = os.Create(fname); err != nil {
+				return err
+			}
+			out = fout
+			fmt.Fprintln(w, fname)
+		}
+		fmt.Fprintf(out, "version %0*d %s %s\n", versionWidth, cmt.version, cmt.when.Format(time.RFC3339), cmt.changes)
+		var err error
+		if parent == 0 {
+			fmt.Fprintln(out, "initial version")
+		} else {
+			err = idx.diffFile(out, path, parent, cmt.version, opts)
+		}
+		if fout != nil {
+			if cerr := fout.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("version %d: %w", cmt.version, err)
+		}
+	}
+	return nil
+}
+
+// diffAll writes the diff of every tracked file that differs
+// from its latest version. Deleted files are skipped.
+func (idx *index) diffAll(w io.Writer, opts diffOptions) error {
+	// commits are sorted by path and descending version
+	for i, cmt := range idx.commits {
+		if i > 0 && idx.commits[i-1].path == cmt.path {
+			continue
+		}
+		if m, err := modified(cmt.path, cmt); err != nil || !m {
+			continue
+		}
+		if err := idx.diffFile(w, cmt.path, cmt.version, 0, opts); err != nil {
+			return fmt.Errorf("%s: %w", cmt.path, err)
+		}
+	}
+	return nil
+}
+
+// diff writes the arguments to temp files and execs diff(1)
+func diff(w io.Writer, from, to []byte, labelFrom, labelTo string) error {
+	fromFile, err := tempFile(from)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fromFile)
+
+	toFile, err := tempFile(to)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(toFile)
+
+	// run diff but ignore exit status
+	cmd := exec.Command("diff", "-u", "--label", labelFrom, "--label", labelTo,
+		fromFile, toFile)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	cmd.Run()
+	return nil
+}
+
+// metaFlag collects repeated key=value flags
+type metaFlag map[string]string
+
+func (m metaFlag) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m metaFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return errors.New("must be key=value")
+	}
+	m[k] = v
+	return nil
+}
+
+var commitMeta = make(metaFlag)
+
+// commitTime is the time of backdated commits, set by -when. New
+// commits get the current time if it is zero.
+var commitTime time.Time
+
+// The flags of main are the flags of older versions, which select the
+// command and its flags. Commands accept copies of the flags that apply
+// to them.
+func init() {
+	flag.Var(commitMeta, "meta", "key=value metadata of commit, or filter of -commits and -search. Can be repeated")
+	flag.Bool("commits", false, "print commits")
+	flag.Bool("full", false, "do not collapse linear runs of versions in the tree")
+	flag.Bool("branches", false, "list the lineages of versions of the file, with their tip, length and last activity")
+	flag.Bool("search", false, "print commits with messages containing -message")
+	flag.String("query", "", "print the commits that match the expression, like 'path ~ \"/etc/\" and when > 2024-01-01 and message ~ \"tls\"'")
+	flag.String("message", "", "text to search for in commit messages")
+	flag.Bool("tree", false, "print commits tree")
+	flag.Bool("list", false, "print tracked files")
+	flag.Bool("verify", false, "verify the stored versions of the file, or with -manifest the store against a saved manifest")
+	flag.Bool("manifest", false, "print the path, version, size and sha256 of every stored version of the file or all files")
+	flag.Bool("renames", false, "find tracked files that were renamed outside sgvc")
+	flag.Bool("auto-follow", false, "with -renames, move the history of renamed files")
+	flag.Bool("mv", false, "move the history, the labels and the refs of the first file to the second, and the file itself if the second does not exist")
+	flag.Bool("link-latest", false, "maintain links to the latest versions in the latest directory of the store")
+	flag.Bool("mirror", false, "copy the store to the mirror directory of the configuration")
+	flag.String("grep", "", "print the lines of -version of the file that match the regular expression")
+	flag.Int("version", 0, "version of -grep, -assert, -which, -lines and -amend, 0 is the latest")
+	flag.String("lines", "", "print only the lines from,to of the version, counted from 1, a missing bound is the first or the last line")
+	flag.Bool("which", false, "print the path of the stored contents of -version, after verifying them")
+	flag.Bool("assert", false, "exit with 0 only if the file equals -version")
+	flag.String("run", "", "run the command after -- and commit the file with this message if it succeeds and changes the file")
+	flag.Bool("edit", false, "commit the file, open it in $EDITOR and commit the changes")
+	flag.String("track", "", "commit the first version of the untracked files, in directories and globs too, with this message")
+	flag.String("snapshot", "", "commit the modified tracked files and the new files matching the track patterns of the configuration with this message")
+	flag.String("prepare", "", "stage versions of the files with this message, to commit them together with -finalize")
+	flag.String("finalize", "", "commit the versions staged by -prepare with this id")
+	flag.String("abort", "", "remove the versions staged by -prepare with this id")
+	flag.String("backup", "", "write a tar archive of the store, or of the versions added since the -since checkpoint, to the file or - for the standard output")
+	flag.Bool("checkout-all", false, "write the latest version of every tracked file under the -o directory")
+	flag.String("at", "", "with -checkout-all and -env, the versions at the date")
+	flag.Bool("env", false, "run the command after -- with SGVC_ROOT set to a temp directory with the versions of the files, or all files, like -checkout-all")
+	flag.Bool("timeline", false, "print the commits of all files in chronological order")
+	flag.String("since", "", "with -timeline, the commits at or after the date, with -backup the checkpoint id or last")
+	flag.String("until", "", "with -timeline, the commits before the date")
+	flag.Bool("events", false, "print the operation log of the store as json lines")
+	flag.Bool("follow", false, "with -events, wait for new events")
+	flag.String("find-hash", "", "print the versions of all files whose contents have the sha256")
+	flag.Int("pin-ref", 0, "pin the external id, the second argument, to this version of the file, 0 is the latest")
+	flag.String("find-ref", "", "print the versions pinned to the external id")
+	flag.Bool("refs", false, "print the external ids pinned to versions of the file or all files")
+	flag.Bool("history-diff", false, "diff every version of the file with its parent, into the -o directory if given")
+	flag.String("range", "", "write the versions from..to as name.vNNNN.ext in the output directory")
+	flag.Bool("export-script", false, "print a shell script that recreates the history of the file in another store")
+	flag.String("diff-store", "", "compare the versions of the file, or all files, with another store")
+	flag.String("export-git", "", "print a git fast-import stream with the histories of the tracked files under the directory, like etckeeper")
+	flag.String("import-git", "", "commit the git histories of the untracked files in the repository of this directory, like etckeeper, as their versions")
+	flag.Bool("doctor", false, "check the store and the environment for common problems")
+	flag.Bool("info", false, "print health indicators of the store")
+	flag.Bool("check", false, "with -info, exit with 1 if an indicator exceeds its threshold in the configuration")
+	flag.Bool("lock-status", false, "print the process holding the store lock and since when")
+	flag.Bool("break-lock", false, "remove the store lock of a crashed sgvc, after confirmation")
+	flag.String("trash", "", "list, empty or restore <id> the commits removed by destructive operations")
+	flag.Bool("forget", false, "stop tracking the file and move all its versions to the trash")
+	flag.Bool("keep-blobs", false, "with -forget, keep the stored contents in the store for archival")
+	flag.Bool("undo", false, "move the latest version of the file to the trash")
+	flag.String("amend", "", "replace the message of -version of the file with this message")
+	flag.Bool("prompt", false, "print a short status of the tracked files in the current directory for shell prompts")
+	flag.String("label", "", "label the latest versions of the files, or all tracked files")
+	flag.Bool("labels", false, "print labels")
+	flag.Int("progress-fd", 0, "write the progress of commits and restores as json lines to the file descriptor, 2 for stderr")
+	flag.Bool("status", false, "print whether the file is clean, modified or untracked, with exit code 0, 10 or 11, or 12 if it was deleted")
+	flag.Int("restore", 0, "overwrite the file with the version, after verifying it, 0 is the latest")
+	flag.Bool("save-current", false, "with -restore, first commit the current contents of the file if they are not committed")
+	flag.Bool("link", false, "restore by reflinking or hard linking the stored contents, for files not edited in place")
+	flag.String("restore-label", "", "restore the files to their labelled versions")
+	flag.Int("export", 0, "write version as name.vNNNN.ext in the output directory, 0 is the latest")
+	flag.Bool("heal", false, "restore corrupted versions from identical copies")
+	flag.Bool("identify", false, "print the versions equal to the file")
+	flag.Bool("stats", false, "print word, line and byte counts of versions")
+	flag.Bool("growth", false, "with -stats, print the monthly growth of the store")
+	flag.Bool("compact", false, "rewrite the index sorted and normalized")
+	flag.Bool("dedupe", false, "report identical contents stored more than once")
+	flag.Bool("report", false, "write an html report of the history in the output directory")
+	flag.String("o", ".", "output directory")
+	flag.Int("cat", 0, "print version, 0 is the latest")
+	flag.String("add", "", "small description of commit")
+	flag.Int("base", 0, "base version of commit, the latest version if not set, 0 for a new root")
+	flag.Bool("force", false, "with -add, commit the file even if it is unchanged since the latest version")
+	flag.Bool("stdin", false, "with -add, commit the standard input as a version of the file, which need not exist")
+	flag.String("add-file", "", "commit the file with the message read from the file")
+	flag.String("when", "", "with -add, the time of the commit, for versions that existed before, not before the latest version or the -base version")
+	flag.String("files", "", "with -add, commit the files of the list, one per line or NUL separated, - for the standard input")
+	flag.Bool("diff", false, "diff versions")
+	flag.Bool("all", false, "diff all tracked files that differ from their latest version")
+	flag.Int("from", 0, "diff from version")
+	flag.Int("to", 0, "diff to version")
+	flag.Bool("raw", false, "diff raw contents, do not convert notebooks and documents to text")
+	flag.String("imgdiff", "", "write a visual diff of images to this file with compare(1)")
+	flag.Int("key", 1, "key column for aligning rows in csv and tsv diffs")
+}
+
+// absPath returns the absolute path of the file, which identifies it in the
+// index. On macOS it is normalized to NFC because HFS+ and some tools return
+// names in NFD and the same file would get two histories. The filesystems of
+// macOS ignore the normalization on lookups, others do not, so it is safe only there.
+func absPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "darwin" {
+		abs = norm.NFC.String(abs)
+	}
+	return abs, nil
+}
+
+// parseRange parses a range of versions from..to, where a missing
+// bound is the first or the last version, or a single version
+func parseRange(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "..")
+	if !ok {
+		to = from
+	}
+	lo, hi := 1, math.MaxInt
+	var err error
+	if from != "" {
+		if lo, err = strconv.Atoi(from); err != nil || lo < 1 {
+			return 0, 0, fmt.Errorf("invalid range %q", s)
+		}
+	}
+	if to != "" {
+		if hi, err = strconv.Atoi(to); err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid range %q", s)
+		}
+	}
+	return lo, hi, nil
+}
+
+// lineRange writes only the lines from..to, counted from 1, of what is written to it
+type lineRange struct {
+	w        io.Writer
+	from, to int
+	line     int // the line of the next byte
+}
+
+func (lr *lineRange) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && lr.line <= lr.to {
+		chunk := p
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			chunk = p[:i+1]
+		}
+		if lr.line >= lr.from {
+			if _, err := lr.w.Write(chunk); err != nil {
+				return 0, err
+			}
+		}
+		if i < 0 {
+			break
+		}
+		lr.line++
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// parseDate parses a date in RFC3339 format, or a day as 2006-01-02
+// in the local time zone
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use 2006-01-02 or RFC3339", s)
+	}
+	return t, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: sgvc <command> [flags] [args]
+       sgvc help <command>
+
+Commands:`)
+	printCommands()
+	fmt.Fprintln(os.Stderr, `
+The flags of older versions select the same commands and are deprecated:
+
+usage: sgvc [-commits|-search|-query <expression>|-tree|-branches|-list|-compact|-dedupe|-verify|-heal|-identify|
+	-status|-stats|-report|-cat [-lines <from,to>]|-grep <regexp>|-assert|-which|-edit|-export|-restore [-save-current] [-link]|
+	-range <from..to>|-export-script|-add|-diff|-history-diff|-diff-store <dir>|-forget [-keep-blobs]|-undo|-amend <message>] <file>
+       sgvc -add <message> [-force] [-when <date>] <file|glob>...
+       sgvc -add '' [-force] <file>
+       sgvc -add-file <message file> [-force] <file|glob>...
+       sgvc -add <message> [-force] -files <list|->
+       sgvc -label <name> [<file>...]
+       sgvc -track <message> <file|dir|glob>...
+       sgvc -import-git <dir> <file|glob>...
+       sgvc -snapshot <message>
+       sgvc -prepare <message> <file|glob>...
+       sgvc -finalize|-abort <id>
+       sgvc -backup <archive|-> [-since <checkpoint|last>]
+       sgvc -run <message> <file> -- <command>...
+       sgvc -mv <file> <new file>
+       sgvc -pin-ref <version> <file> <ref>
+       sgvc -checkout-all -o <dir> [-at <date>|-label <name>]
+       sgvc -env [-at <date>|-label <name>] [<file|dir>...] -- <command>...
+       sgvc [-labels|-restore-label <name> [-link]|-prompt|-link-latest|-mirror|-doctor|-info [-check]|-lock-status|-break-lock|-find-hash <sha256>|-find-ref <ref>|-export-git <dir>|
+	-timeline [-since <date>] [-until <date>]|-events [-follow]|-renames [-auto-follow]]
+       sgvc -manifest [<file>]
+       sgvc -manifest -verify <manifest>
+       sgvc -trash list|empty|restore <id>
+
+sgvc provides version control for single files. You can commit, read, log, diff
+and maintain all the versions of a file. The are no repos. Every file is uniquely identified
+by the absolute path and everything is stored in a single work directory currently $HOME/.cache/sgvc.
+
+Examples:
+$ sgvc add -m 'deploy production' deploy.sh
+$ sgvc log
+deploy.sh 20240501T00:00:00Z 0001 0000 "deploy production"
+$ sgvc add -m 'deploy production with redis' -base 1 deploy.sh
+
+Flags:`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	log.SetPrefix("")
+	log.SetFlags(0)
+	flag.Usage = usage
+	c, fs, args := parseCommandLine()
+
+	cf, err := loadConfig()
+	if err != nil {
+		log.Fatalf("failed to read configuration: %v", err)
+	}
+	conf = cf
+
+	if fd := intFlag(fs, "progress-fd"); fd != 0 {
+		if err := setProgressFd(fd); err != nil {
+			log.Fatalf("invalid -progress-fd %d: %v", fd, err)
+		}
+	}
+
+	idx, err := getIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the doctor must see the problems before they are fixed
+	if c.name != "doctor" {
+		hardenStore(idx.workDir, idx.manifest.layout, false)
+	}
+
+	err = c.run(idx, fs, args)
+	var uerr usageError
+	var code exitCode
+	switch {
+	case err == nil:
+	case errors.As(err, &uerr):
+		if uerr != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", c.name, uerr)
+		}
+		fs.Usage()
+		os.Exit(2)
+	case errors.As(err, &code):
+		os.Exit(int(code))
+	default:
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Staged versions are prepared, checked and copied to the store without
+// being committed, and committed later all together or not at all. An
+// orchestrator that rolls out files to several hosts prepares them on
+// every host and finalizes them only if every prepare succeeded
+//
+//	id=$(sgvc -prepare 'rollout 42' nginx.conf site.conf)
+//	sgvc -finalize $id   # or sgvc -abort $id
+//
+// The directory of a staged entry has an index file with the lines of
+// the versions, with version 0 and the base they are prepared on, and
+// their contents named by the number of their line.
+
+// stagedDir returns the directory of the staged entries
+func (idx *index) stagedDir() string {
+	return filepath.Join(idx.workDir, "staged")
+}
+
+// stagedInfo is the file of a staged version as it was when prepared
+type stagedInfo struct {
+	cmt *commit
+}
+
+func (fi stagedInfo) Name() string       { return filepath.Base(fi.cmt.path) }
+func (fi stagedInfo) Size() int64        { return fi.cmt.size }
+func (fi stagedInfo) Mode() fs.FileMode  { return fi.cmt.mode }
+func (fi stagedInfo) ModTime() time.Time { return fi.cmt.mtime }
+func (fi stagedInfo) IsDir() bool        { return false }
+func (fi stagedInfo) Sys() any           { return nil }
+
+// prepare stages a version of every file, based on its latest version,
+// with the message and returns the id of the staged entry. Nothing is
+// staged if any file cannot be committed.
+func (idx *index) prepare(paths []string, message string) (string, error) {
+	for _, path := range paths {
+		if err := committable(path); err != nil {
+			return "", err
+		}
+	}
+	if err := mkdirAll(idx.stagedDir()); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	id := now.Format("20060102T150405")
+	dir := filepath.Join(idx.stagedDir(), id)
+	for n := 2; ; n++ {
+		err := mkdir(dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		id = fmt.Sprintf("%s.%d", now.Format("20060102T150405"), n)
+		dir = filepath.Join(idx.stagedDir(), id)
+	}
+
+	var lines []string
+	for i, path := range paths {
+		// stat before reading, a file modified while reading gets a newer mtime
+		fi, err := os.Stat(path)
+		if err == nil {
+			var data []byte
+			if data, err = os.ReadFile(path); err == nil {
+				cmt := &commit{
+					path:    path,
+					when:    now,
+					basedOn: idx.currVersion(path),
+					changes: strconv.Quote(message),
+					size:    int64(len(data)),
+					mtime:   fi.ModTime(),
+					mode:    fi.Mode().Perm(),
+					meta:    commitMeta,
+					sum:     hashSum(idx.manifest.versionHash(), data),
+					hash:    idx.manifest.versionHash(),
+				}
+				lines = append(lines, cmt.serialize())
+				err = os.WriteFile(filepath.Join(dir, strconv.Itoa(i+1)), data, fileMode)
+			}
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to prepare %s: %w", path, err)
+		}
+	}
+	if err := appendLines(filepath.Join(dir, "index"), lines); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return id, nil
+}
+
+// loadStaged returns the versions of the staged entry
+func (idx *index) loadStaged(id string) ([]*commit, error) {
+	fin, err := os.Open(filepath.Join(idx.stagedDir(), filepath.Base(id), "index"))
+	if err != nil {
+		return nil, fmt.Errorf("no staged entry %s: %w", id, err)
+	}
+	defer fin.Close()
+
+	var commits []*commit
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		cmt, err := deserializeCommit(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, cmt)
+	}
+	return commits, scanner.Err()
+}
+
+// finalize commits the versions of the staged entry and removes it.
+// Nothing is committed if a file was committed since it was prepared
+// or the staged contents are damaged, and the entry is kept to finalize
+// or abort it again.
+func (idx *index) finalize(id string) error {
+	commits, err := idx.loadStaged(id)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(idx.stagedDir(), filepath.Base(id))
+	batch := make([]*pending, len(commits))
+	for i, cmt := range commits {
+		data, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(i+1)))
+		if err != nil {
+			return err
+		}
+		if !verifyData(cmt, data) {
+			return fmt.Errorf("the staged contents of %s are damaged, nothing committed", cmt.path)
+		}
+		batch[i] = &pending{
+			path:    cmt.path,
+			data:    data,
+			fi:      stagedInfo{cmt},
+			basedOn: cmt.basedOn,
+			latest:  true,
+			changes: cmt.message(),
+			meta:    cmt.meta,
+			prog:    newProgress("commit", cmt.path, cmt.size),
+		}
+	}
+	// the versions are checked and appended to the index with the store locked once
+	if err := idx.commitBatch(batch, true); err != nil {
+		if batch[0].cmt == nil {
+			return fmt.Errorf("%w, nothing committed", err)
+		}
+		// the versions are committed, only the pruning or the mirror failed
+		os.RemoveAll(dir)
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// abort removes the staged entry without committing it
+func (idx *index) abort(id string) error {
+	if _, err := idx.loadStaged(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(idx.stagedDir(), filepath.Base(id)))
+}
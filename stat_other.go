@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileOwner is not supported on this platform
+func fileOwner(fi os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+// fileID is not supported on this platform
+func fileID(fi os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
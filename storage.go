@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// storage policies of the storage key of the configuration
+const (
+	storeWhole    = "whole"
+	storeCompress = "compress"
+	storeDelta    = "delta"
+	storeReject   = "reject"
+)
+
+// encodingGzip is the encoding of blobs of compressed versions
+const encodingGzip = "gzip"
+
+// storagePolicy returns how the file is stored, set by the storage key
+// of the configuration. The default is to store it whole, for example
+//
+//	storage *.log = compress
+//	storage *.sql = delta
+//	storage *.iso = reject
+func storagePolicy(path string) (string, error) {
+	v, ok := conf.forPath("storage", path)
+	if !ok {
+		return storeWhole, nil
+	}
+	switch v {
+	case storeWhole, storeCompress, storeDelta, storeReject:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown storage policy %q for %s", v, path)
+}
+
+// maxSize returns the maximum size of the file, set by the max-size key of
+// the configuration with an optional K, M or G suffix, or 0 for no limit
+func maxSize(path string) int64 {
+	v, ok := conf.forPath("max-size", path)
+	if !ok {
+		return 0
+	}
+	n, err := parseSize(v)
+	if err != nil || n < 0 {
+		log.Printf("WARNING: invalid max-size %q for %s", v, path)
+		return 0
+	}
+	return n
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		s, unit = strings.TrimSuffix(s, "K"), 1<<10
+	case strings.HasSuffix(s, "M"):
+		s, unit = strings.TrimSuffix(s, "M"), 1<<20
+	case strings.HasSuffix(s, "G"):
+		s, unit = strings.TrimSuffix(s, "G"), 1<<30
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+// encodeBlob writes the contents of a version, or the instructions of a
+// delta, to the blob in the encoding. Deltas are compressed too.
+func encodeBlob(w io.Writer, data []byte, encoding string) error {
+	if encoding != encodingGzip && encoding != encodingDelta {
+		_, err := w.Write(data)
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decodeBlob returns the contents of the version of the commit from its blob
+func (idx *index) decodeBlob(cmt *commit, blob []byte) ([]byte, error) {
+	if cmt.encoding == "" {
+		return blob, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil || cmt.encoding != encodingDelta {
+		return data, err
+	}
+	base, err := idx.extract(cmt.path, cmt.delta)
+	if err != nil {
+		return nil, fmt.Errorf("delta base: %w", err)
+	}
+	return applyDelta(base, data)
+}
+
+// openBlob opens the blob of the commit for reading its contents
+func (idx *index) openBlob(cmt *commit) (io.ReadCloser, error) {
+	if cmt.encoding == encodingDelta {
+		blob, err := os.ReadFile(idx.filePath(cmt))
+		if err != nil {
+			return nil, err
+		}
+		data, err := idx.decodeBlob(cmt, blob)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	fin, err := os.Open(idx.filePath(cmt))
+	if err != nil || cmt.encoding != encodingGzip {
+		return fin, err
+	}
+	zr, err := gzip.NewReader(fin)
+	if err != nil {
+		fin.Close()
+		return nil, err
+	}
+	return &gzipBlob{zr, fin}, nil
+}
+
+// gzipBlob reads a compressed blob and closes its file
+type gzipBlob struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (b *gzipBlob) Close() error {
+	b.Reader.Close()
+	return b.f.Close()
+}
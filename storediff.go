@@ -0,0 +1,58 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// diffStores prints the versions of the files, or all files if path is
+// empty, that are only in idx, marked with <, only in other, marked with >,
+// or in both with different contents, marked with !. It returns the
+// number of differences.
+func diffStores(w io.Writer, idx, other *index, path string) int {
+	type key struct {
+		path    string
+		version int
+	}
+	mine := make(map[key]*commit)
+	for _, cmt := range idx.filter(path) {
+		mine[key{cmt.path, cmt.version}] = cmt
+	}
+	theirs := make(map[key]*commit)
+	for _, cmt := range other.filter(path) {
+		theirs[key{cmt.path, cmt.version}] = cmt
+	}
+
+	type difference struct {
+		mark string
+		cmt  *commit
+	}
+	var diffs []difference
+	for k, cmt := range mine {
+		o, ok := theirs[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, difference{"<", cmt})
+		case o.dataCrc != cmt.dataCrc || !o.mtime.IsZero() && !cmt.mtime.IsZero() && o.size != cmt.size:
+			diffs = append(diffs, difference{"!", cmt})
+		}
+	}
+	for k, cmt := range theirs {
+		if _, ok := mine[k]; !ok {
+			diffs = append(diffs, difference{">", cmt})
+		}
+	}
+	slices.SortFunc(diffs, func(a, b difference) int {
+		if c := strings.Compare(a.cmt.path, b.cmt.path); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.cmt.version, b.cmt.version)
+	})
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%s %s\t%0*d\t%s\n", d.mark, d.cmt.path, versionWidth, d.cmt.version, d.cmt.changes)
+	}
+	return len(diffs)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// textconvs maps file extensions to functions that convert the contents
+// of a file to a text representation suitable for diff(1)
+var textconvs = map[string]func([]byte) ([]byte, error){
+	".ipynb": notebookText,
+	".docx":  docxText,
+	".odt":   odtText,
+}
+
+// proseExts are the extensions of documents whose text is diffed word by
+// word, a paragraph is a single line and diffs of lines would show whole
+// paragraphs for a changed word
+var proseExts = map[string]bool{
+	".docx": true,
+	".odt":  true,
+}
+
+// textconv converts data to text using the converter for the path extension.
+// Data is returned unchanged if there is no converter.
+func textconv(path string, data []byte) ([]byte, error) {
+	conv, ok := textconvs[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return data, nil
+	}
+	return conv(data)
+}
+
+// wordLines returns the text of a prose document with one word per line
+// and an empty line after every paragraph, for diff(1) to diff it word by
+// word. Text of other files is returned unchanged.
+func wordLines(path string, text []byte) []byte {
+	if !proseExts[strings.ToLower(filepath.Ext(path))] {
+		return text
+	}
+	var b bytes.Buffer
+	for _, para := range strings.Split(string(text), "\n") {
+		words := strings.Fields(para)
+		if len(words) == 0 {
+			continue
+		}
+		for _, word := range words {
+			b.WriteString(word)
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// notebookText extracts the cell sources of a jupyter notebook.
+// Outputs, execution counts and metadata are dropped.
+func notebookText(data []byte) ([]byte, error) {
+	var nb struct {
+		Cells []struct {
+			CellType string          `json:"cell_type"`
+			Source   json.RawMessage `json:"source"`
+		} `json:"cells"`
+	}
+	if err := json.Unmarshal(data, &nb); err != nil {
+		return nil, fmt.Errorf("malformed notebook: %w", err)
+	}
+
+	var b bytes.Buffer
+	for i, cell := range nb.Cells {
+		// source is either a string or a list of lines
+		var src string
+		var lines []string
+		if err := json.Unmarshal(cell.Source, &src); err != nil {
+			if err := json.Unmarshal(cell.Source, &lines); err != nil {
+				return nil, fmt.Errorf("malformed notebook cell %d", i+1)
+			}
+			src = strings.Join(lines, "")
+		}
+		fmt.Fprintf(&b, "# cell %d [%s]\n", i+1, cell.CellType)
+		b.WriteString(src)
+		if !strings.HasSuffix(src, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// docxText extracts the paragraphs of a word document, one per line
+func docxText(data []byte) ([]byte, error) {
+	return zipXMLText(data, "word/document.xml", "p")
+}
+
+// odtText extracts the paragraphs and headings of an opendocument text, one per line
+func odtText(data []byte) ([]byte, error) {
+	return zipXMLText(data, "content.xml", "p", "h")
+}
+
+// zipXMLText reads the xml document name from the zip archive in data and
+// returns the character data of its elements. Elements with local name
+// in paras are terminated by a newline.
+func zipXMLText(data []byte, name string, paras ...string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed document: %w", err)
+	}
+	f, err := zr.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("malformed document: %w", err)
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed document: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			b.Write(t)
+		case xml.EndElement:
+			for _, p := range paras {
+				if t.Name.Local == p {
+					b.WriteString("\n")
+				}
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// tmpPrefix identifies the temporary files of sgvc
+	tmpPrefix = "sgvc-"
+	// tmpMaxAge is the age after which a temporary file is considered
+	// a leftover of an interrupted run
+	tmpMaxAge = 24 * time.Hour
+)
+
+// tmpDir is the directory for temporary files. It is in the store, so
+// that temporary files can be renamed to blobs. It is set by getIndex.
+var tmpDir string
+
+// createTemp creates a new temporary file in tmpDir
+func createTemp() (*os.File, error) {
+	f, err := os.CreateTemp(tmpDir, tmpPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	// temporary files become blobs and indexes of the store
+	if err := f.Chmod(fileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// tempFile writes data to a new temporary file and returns its name
+func tempFile(data []byte) (string, error) {
+	f, err := createTemp()
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// cleanTemp removes the temporary files left over from interrupted runs
+func cleanTemp() {
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), tmpPrefix) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > tmpMaxAge {
+			os.Remove(filepath.Join(tmpDir, e.Name()))
+		}
+	}
+}
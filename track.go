@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// trackable expands the arguments to the files they name. Directories
+// are walked recursively and arguments with glob metacharacters are
+// expanded, for shells that did not. Only regular files are returned,
+// never the files of the store. Files named explicitly that are skipped,
+// like symbolic links, are warned about.
+func (idx *index) trackable(args []string) ([]string, error) {
+	var paths []string
+	add := func(path string, explicit bool) error {
+		abs, err := absPath(path)
+		if err != nil {
+			return err
+		}
+		if abs == idx.workDir || strings.HasPrefix(abs, idx.workDir+string(filepath.Separator)) {
+			if explicit {
+				log.Printf("WARNING: %s is in the store, skipped", path)
+			}
+			return nil
+		}
+		paths = append(paths, abs)
+		return nil
+	}
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil {
+				return nil, fmt.Errorf("%s: %w", arg, err)
+			}
+		}
+		for _, m := range matches {
+			err := filepath.WalkDir(m, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				explicit := path == arg
+				switch {
+				case d.Type().IsRegular():
+					return add(path, explicit)
+				case explicit && d.Type()&fs.ModeSymlink != 0:
+					log.Printf("WARNING: %s is a symbolic link, skipped, name the file it links to", path)
+				case explicit && !d.IsDir():
+					log.Printf("WARNING: %s is not a regular file, skipped", path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// arguments may overlap
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
+
+// track commits the first version of the files that are not tracked, with
+// the same message. It returns the tracked files and how many failed.
+func (idx *index) track(paths []string, message string) ([]string, int) {
+	var batch []*pending
+	for _, path := range paths {
+		if idx.currVersion(path) == 0 {
+			batch = append(batch, pendingFile(path, 0, message, commitMeta))
+		}
+	}
+	err := idx.commitBatch(batch, false)
+	var tracked []string
+	failed := 0
+	for _, p := range batch {
+		if p.cmt != nil {
+			tracked = append(tracked, p.path)
+		} else if p.err != nil {
+			log.Printf("failed to track %s: %v", p.path, p.err)
+			failed++
+		}
+	}
+	if err != nil {
+		log.Printf("failed to track the files: %v", err)
+		failed = max(len(batch)-len(tracked), 1)
+	}
+	return tracked, failed
+}
+
+// reportBatch prints M for the modified and A for the added files of the
+// batch that were committed, logs the others and returns how many failed
+func reportBatch(w io.Writer, batch []*pending, err error) int {
+	failed, committed := 0, 0
+	for _, p := range batch {
+		switch {
+		case p.cmt != nil && p.basedOn > 0:
+			fmt.Fprintf(w, "M %s\n", p.path)
+			committed++
+		case p.cmt != nil:
+			fmt.Fprintf(w, "A %s\n", p.path)
+			committed++
+		case p.err != nil:
+			log.Printf("failed to commit %s: %v", p.path, p.err)
+			failed++
+		}
+	}
+	if err != nil {
+		log.Printf("failed to commit the files: %v", err)
+		failed = max(len(batch)-committed, 1)
+	}
+	return failed
+}
+
+// globPaths returns the files matching the pattern. The pattern is of
+// filepath.Match, except that ** matches any number of directories
+// and a leading ~ is the home directory.
+func globPaths(pattern string) ([]string, error) {
+	if rest, ok := strings.CutPrefix(pattern, "~"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		pattern = home + rest
+	}
+	pattern = filepath.Clean(pattern)
+	before, _, ok := strings.Cut(pattern, "**")
+	if !ok {
+		return filepath.Glob(pattern)
+	}
+
+	// walk the directories before the first ** and match the rest
+	roots, err := filepath.Glob(filepath.Dir(before + "x"))
+	if err != nil {
+		return nil, err
+	}
+	patSegs := strings.Split(pattern, string(filepath.Separator))
+	var paths []string
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// unreadable directories are skipped
+				return nil
+			}
+			if d.Type().IsRegular() && matchSegments(patSegs, strings.Split(path, string(filepath.Separator))) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// matchSegments reports whether the path segments match the pattern
+// segments, where a ** segment matches any number of path segments
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// snapshot commits, with the same message, the tracked files that are
+// modified and the untracked files that match the track patterns of the
+// configuration. It prints M for modified and A for added files and
+// returns how many failed.
+func (idx *index) snapshot(w io.Writer, message string) int {
+	var batch []*pending
+	for _, path := range idx.paths() {
+		cmt, err := idx.lookup(path, idx.currVersion(path))
+		if err != nil {
+			continue
+		}
+		// deleted files are not snapshotted
+		m, err := modified(path, cmt)
+		if err != nil || !m {
+			continue
+		}
+		batch = append(batch, pendingFile(path, cmt.version, message, commitMeta))
+	}
+
+	var found []string
+	for _, pattern := range conf.values("track") {
+		paths, err := globPaths(pattern)
+		if err != nil {
+			log.Printf("WARNING: track pattern %s: %v", pattern, err)
+			continue
+		}
+		found = append(found, paths...)
+	}
+	added, err := idx.trackable(found)
+	if err != nil {
+		log.Printf("failed to find new files: %v", err)
+	}
+	for _, path := range added {
+		if idx.currVersion(path) == 0 {
+			batch = append(batch, pendingFile(path, 0, message, commitMeta))
+		}
+	}
+	failed := reportBatch(w, batch, idx.commitBatch(batch, false))
+	if err != nil {
+		failed++
+	}
+	return failed
+}
+
+// committable returns an error if the file cannot be committed, checked
+// before committing any file of -add with many files
+func committable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	policy, err := storagePolicy(path)
+	if err != nil {
+		return err
+	}
+	if policy == storeReject {
+		return fmt.Errorf("the storage policy rejects %s", path)
+	}
+	if limit := maxSize(path); limit > 0 && fi.Size() > limit {
+		return fmt.Errorf("%s has %d bytes, more than the max-size %d", path, fi.Size(), limit)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// addFiles commits every file, each with its own version and the same
+// message. All the files are checked first and if any cannot be
+// committed nothing is, the versions are committed together. Files unchanged since their latest version are
+// skipped unless force is set. It prints M for modified and A for added
+// files and returns how many failed.
+func (idx *index) addFiles(w io.Writer, paths []string, message string, force bool) int {
+	failed := 0
+	for _, path := range paths {
+		if err := committable(path); err != nil {
+			log.Print(err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d of the files cannot be committed, nothing committed", failed)
+		return failed
+	}
+
+	var batch []*pending
+	for _, path := range paths {
+		v := idx.currVersion(path)
+		if v > 0 && !force {
+			cmt, err := idx.lookup(path, v)
+			if err != nil {
+				log.Printf("failed to commit %s: %v", path, err)
+				failed++
+				continue
+			}
+			if same, err := idx.unchanged(path, cmt); err != nil {
+				log.Printf("failed to commit %s: %v", path, err)
+				failed++
+				continue
+			} else if same {
+				fmt.Fprintf(os.Stderr, "%s is unchanged since version %d, nothing committed, use -force to commit it\n", path, v)
+				continue
+			}
+		}
+		batch = append(batch, pendingFile(path, v, message, commitMeta))
+	}
+	if failed > 0 {
+		log.Printf("%d of the files cannot be committed, nothing committed", failed)
+		return failed
+	}
+	return reportBatch(w, batch, idx.commitBatch(batch, true))
+}
+
+// readPathList reads the paths of a list, one per line or, if the list
+// has NUL characters like the output of find -print0, separated by NUL.
+// Empty entries are skipped.
+func readPathList(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, p := range strings.Split(string(data), sep) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// isGlob reports whether the argument is a glob, one with metacharacters
+// that is not the name of a file
+func isGlob(arg string) bool {
+	_, err := os.Stat(arg)
+	return strings.ContainsAny(arg, "*?[") && err != nil
+}
+
+// expandFiles returns the absolute paths of the arguments, with the
+// globs expanded for shells that did not, sorted and without repeats
+func expandFiles(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		matches := []string{arg}
+		if isGlob(arg) {
+			var err error
+			if matches, err = filepath.Glob(arg); err != nil || len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+		}
+		for _, m := range matches {
+			path, err := absPath(m)
+			if err != nil {
+				return nil, fmt.Errorf("resolution failed: %w", err)
+			}
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trashDays is the number of days a trash entry is kept when the
+// configuration does not set trash-days
+const trashDays = 30
+
+// trashEntry is a set of commits removed from the index by a destructive
+// operation. The directory of the entry has a reason file, an index file
+// with the lines of the commits and the blobs of the commits named by the
+// number of their line, if they were removed too. The labels and refs of
+// the commits, if any, are in the labels and refs files.
+type trashEntry struct {
+	id      string
+	when    time.Time
+	reason  string
+	commits []*commit
+	labels  []label
+	refs    []ref
+}
+
+// trashDir returns the directory of the trash entries
+func (idx *index) trashDir() string {
+	return filepath.Join(idx.workDir, "trash")
+}
+
+// trashExpiry returns how long trash entries are kept
+func trashExpiry() time.Duration {
+	days := trashDays
+	if v := conf.get("trash-days"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			days = n
+		} else {
+			log.Printf("WARNING: invalid trash-days %q, using %d", v, trashDays)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// trash moves the commits to a new trash entry and returns its id. If
+// blobs is set their blobs are moved too, otherwise they are still in use.
+// The caller must remove the commits from the index. It must be called
+// with the store locked. Expired entries are removed.
+func (idx *index) trash(reason string, commits []*commit, blobs bool) (string, error) {
+	if err := idx.emptyTrash(false); err != nil {
+		log.Printf("WARNING: failed to remove expired trash: %v", err)
+	}
+	if err := mkdirAll(idx.trashDir()); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	id := now.Format("20060102T150405")
+	dir := filepath.Join(idx.trashDir(), id)
+	for n := 2; ; n++ {
+		err := mkdir(dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		id = fmt.Sprintf("%s.%d", now.Format("20060102T150405"), n)
+		dir = filepath.Join(idx.trashDir(), id)
+	}
+
+	trashed := make(map[*commit]bool)
+	for _, cmt := range commits {
+		trashed[cmt] = true
+	}
+	var deltas []string
+	if blobs {
+		// the trash keeps deltas whole, their bases may be gone when restored
+		var err error
+		if commits, deltas, err = idx.storeWhole(commits, nil); err != nil {
+			return "", err
+		}
+	}
+	var lines []string
+	for _, cmt := range commits {
+		lines = append(lines, cmt.serialize())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "reason"), []byte(reason+"\n"), fileMode); err != nil {
+		return "", err
+	}
+	if err := appendLines(filepath.Join(dir, "index"), lines); err != nil {
+		return "", err
+	}
+	if blobs {
+		// blobs shared with versions that are not trashed, in the hash
+		// layout, are copied and removed only if no version is left
+		shared := make(map[string]bool)
+		for _, cmt := range idx.commits {
+			if !trashed[cmt] {
+				shared[idx.filePath(cmt)] = true
+			}
+		}
+		for i, cmt := range commits {
+			err := linkOrCopy(idx.filePath(cmt), filepath.Join(dir, strconv.Itoa(i+1)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("failed to trash version %d of %s: %w", cmt.version, cmt.path, err)
+			}
+		}
+		for _, cmt := range commits {
+			if blob := idx.filePath(cmt); !shared[blob] {
+				os.Remove(blob)
+			}
+		}
+		for _, blob := range deltas {
+			os.Remove(blob)
+		}
+	}
+	return id, nil
+}
+
+// trashMarks moves the labels and refs of the versions that match to the
+// trash entry. It must be called with the store locked.
+func (idx *index) trashMarks(id string, match func(path string, version int) bool) error {
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return err
+	}
+	refs, err := idx.loadRefs()
+	if err != nil {
+		return err
+	}
+	var trashedLabels, keptLabels []label
+	for _, l := range labels {
+		if match(l.path, l.version) {
+			trashedLabels = append(trashedLabels, l)
+		} else {
+			keptLabels = append(keptLabels, l)
+		}
+	}
+	var trashedRefs, keptRefs []ref
+	for _, r := range refs {
+		if match(r.path, r.version) {
+			trashedRefs = append(trashedRefs, r)
+		} else {
+			keptRefs = append(keptRefs, r)
+		}
+	}
+	dir := filepath.Join(idx.trashDir(), id)
+	if len(trashedLabels) > 0 {
+		if err := writeLabels(filepath.Join(dir, "labels"), trashedLabels); err != nil {
+			return err
+		}
+		if err := writeLabels(idx.labelsFile(), keptLabels); err != nil {
+			return err
+		}
+	}
+	if len(trashedRefs) > 0 {
+		if err := writeRefs(filepath.Join(dir, "refs"), trashedRefs); err != nil {
+			return err
+		}
+		if err := writeRefs(idx.refsFile(), keptRefs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTrash returns the trash entries, oldest first
+func (idx *index) loadTrash() ([]*trashEntry, error) {
+	entries, err := os.ReadDir(idx.trashDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var trash []*trashEntry
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		te, err := idx.loadTrashEntry(e.Name())
+		if err != nil {
+			log.Printf("WARNING: damaged trash entry %s: %v", e.Name(), err)
+			continue
+		}
+		trash = append(trash, te)
+	}
+	slices.SortFunc(trash, func(a, b *trashEntry) int {
+		return strings.Compare(a.id, b.id)
+	})
+	return trash, nil
+}
+
+// loadTrashEntry reads the trash entry with the id
+func (idx *index) loadTrashEntry(id string) (*trashEntry, error) {
+	dir := filepath.Join(idx.trashDir(), id)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	reason, err := os.ReadFile(filepath.Join(dir, "reason"))
+	if err != nil {
+		return nil, err
+	}
+	fin, err := os.Open(filepath.Join(dir, "index"))
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	te := &trashEntry{id: id, when: fi.ModTime(), reason: strings.TrimSpace(string(reason))}
+	scanner := bufio.NewScanner(fin)
+	for scanner.Scan() {
+		cmt, err := deserializeCommit(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		te.commits = append(te.commits, cmt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if te.labels, err = readLabels(filepath.Join(dir, "labels")); err != nil {
+		return nil, err
+	}
+	if te.refs, err = readRefs(filepath.Join(dir, "refs")); err != nil {
+		return nil, err
+	}
+	return te, nil
+}
+
+// restoreTrash puts the commits of the trash entry back in the index, with
+// their labels and refs, and removes the entry. Commits identical to ones
+// in the index are skipped, other commits with the same path and version
+// are conflicts, like labels with the same name and path.
+func (idx *index) restoreTrash(id string) error {
+	if err := idx.lock(); err != nil {
+		return err
+	}
+	defer idx.unlock()
+
+	// reload, the index may have changed before locking
+	if err := idx.loadCommits(); err != nil {
+		return err
+	}
+	te, err := idx.loadTrashEntry(id)
+	if err != nil {
+		return fmt.Errorf("no trash entry %s: %w", id, err)
+	}
+	dir := filepath.Join(idx.trashDir(), id)
+	// check every commit before moving any blob
+	restored := make(map[int]*commit)
+	for i, cmt := range te.commits {
+		if cur, err := idx.lookup(cmt.path, cmt.version); err == nil {
+			if cur.serialize() == cmt.serialize() {
+				continue
+			}
+			return fmt.Errorf("version %d of %s exists, cannot restore, nothing restored", cmt.version, cmt.path)
+		}
+		restored[i] = cmt
+	}
+	labels, err := idx.loadLabels()
+	if err != nil {
+		return err
+	}
+	var labelLines []string
+	for _, l := range te.labels {
+		i := slices.IndexFunc(labels, func(cur label) bool { return cur.name == l.name && cur.path == l.path })
+		if i >= 0 && labels[i] != l {
+			return fmt.Errorf("label %s of %s exists, cannot restore, nothing restored", l.name, l.path)
+		}
+		if i < 0 {
+			labelLines = append(labelLines, fmt.Sprintf("%s\t%s\t%0*d", l.name, l.path, versionWidth, l.version))
+		}
+	}
+	refs, err := idx.loadRefs()
+	if err != nil {
+		return err
+	}
+	var refLines []string
+	for _, r := range te.refs {
+		if !slices.Contains(refs, r) {
+			refLines = append(refLines, fmt.Sprintf("%s\t%s\t%0*d", r.id, r.path, versionWidth, r.version))
+		}
+	}
+	var lines []string
+	var moved [][2]string
+	for i, cmt := range te.commits {
+		if restored[i] == nil {
+			continue
+		}
+		src, blob := filepath.Join(dir, strconv.Itoa(i+1)), idx.filePath(cmt)
+		err := mkdirAll(filepath.Dir(blob))
+		if err == nil {
+			err = os.Rename(src, blob)
+		}
+		if err == nil {
+			moved = append(moved, [2]string{src, blob})
+		} else if !errors.Is(err, os.ErrNotExist) {
+			// put the blobs back, the entry can be restored again
+			for _, m := range moved {
+				os.Rename(m[1], m[0])
+			}
+			return fmt.Errorf("failed to restore version %d of %s, nothing restored: %w", cmt.version, cmt.path, err)
+		}
+		lines = append(lines, cmt.serialize())
+	}
+	if err := appendLines(idx.commitsFile, lines); err != nil {
+		for _, m := range moved {
+			os.Rename(m[1], m[0])
+		}
+		return err
+	}
+	if len(labelLines) > 0 {
+		if err := appendLines(idx.labelsFile(), labelLines); err != nil {
+			return err
+		}
+	}
+	if len(refLines) > 0 {
+		if err := appendLines(idx.refsFile(), refLines); err != nil {
+			return err
+		}
+	}
+	idx.logEvent("untrash", "", 0, id)
+	if err := idx.loadCommits(); err != nil {
+		return err
+	}
+	if idx.latestEnabled() {
+		if err := idx.refreshLatest(); err != nil {
+			log.Printf("WARNING: failed to update the latest view: %v", err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := idx.replicate(nil); err != nil {
+		return fmt.Errorf("failed to mirror store: %w", err)
+	}
+	return nil
+}
+
+// emptyTrash removes the expired trash entries, or all if all is set.
+// It must be called with the store locked.
+func (idx *index) emptyTrash(all bool) error {
+	trash, err := idx.loadTrash()
+	if err != nil {
+		return err
+	}
+	expiry := trashExpiry()
+	for _, te := range trash {
+		if all || time.Since(te.when) > expiry {
+			if err := os.RemoveAll(filepath.Join(idx.trashDir(), te.id)); err != nil {
+				return err
+			}
+			idx.logEvent("purge", "", 0, te.id)
+		}
+	}
+	return nil
+}
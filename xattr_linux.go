@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes of the file. POSIX ACLs,
+// SELinux contexts and file capabilities are extended attributes too.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00") {
+		n, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(path, name, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		attrs[name] = string(value[:n])
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the extended attributes of the file
+func writeXattrs(path string, attrs map[string]string) error {
+	var errs []error
+	for name, value := range attrs {
+		if err := syscall.Setxattr(path, name, []byte(value), 0); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
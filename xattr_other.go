@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// readXattrs is not supported on this platform
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattrs is not supported on this platform
+func writeXattrs(path string, attrs map[string]string) error {
+	if len(attrs) > 0 {
+		return errors.New("extended attributes are not supported on this platform")
+	}
+	return nil
+}